@@ -3,27 +3,63 @@
 package hints
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/kovidgoyal/kitty/tools/cli"
 	"github.com/kovidgoyal/kitty/tools/tty"
 	"github.com/kovidgoyal/kitty/tools/tui"
 	"github.com/kovidgoyal/kitty/tools/tui/loop"
 	"github.com/kovidgoyal/kitty/tools/utils"
+	"github.com/kovidgoyal/kitty/tools/utils/shlex"
 	"github.com/kovidgoyal/kitty/tools/utils/style"
 	"github.com/kovidgoyal/kitty/tools/wcswidth"
 )
 
 var _ = fmt.Print
 
+const DEFAULT_TAB_WIDTH = 8
+
+// expand_tabs replaces tabs in a single screen line with spaces up to the next
+// multiple of tab_width cells
+func expand_tabs(line string, tab_width int) string {
+	if tab_width < 1 || !strings.Contains(line, "\t") {
+		return line
+	}
+	buf := strings.Builder{}
+	buf.Grow(len(line) + 4*tab_width)
+	col := 0
+	for i, part := range strings.Split(line, "\t") {
+		if i > 0 {
+			n := tab_width - col%tab_width
+			buf.WriteString(strings.Repeat(" ", n))
+			col += n
+		}
+		buf.WriteString(part)
+		col += wcswidth.Stringwidth(part)
+	}
+	return buf.String()
+}
+
 func convert_text(text string, cols int) string {
+	return convert_text_with_tab_width(text, cols, DEFAULT_TAB_WIDTH)
+}
+
+func convert_text_with_tab_width(text string, cols, tab_width int) string {
+	// lines are not padded when the width is unknown
+	cols = max(0, cols)
 	lines := make([]string, 0, 64)
 	empty_line := strings.Repeat("\x00", cols) + "\n"
 	s1 := utils.NewLineScanner(text)
@@ -42,7 +78,7 @@ func convert_text(text string, cols int) string {
 		appended := false
 		s2 := utils.NewSeparatorScanner(full_line, "\r")
 		for s2.Scan() {
-			line := s2.Text()
+			line := expand_tabs(s2.Text(), tab_width)
 			if line != "" {
 				line_sz := wcswidth.Stringwidth(line)
 				extra := cols - line_sz
@@ -62,20 +98,48 @@ func convert_text(text string, cols int) string {
 	return strings.TrimRight(ans, "\r\n")
 }
 
-func parse_input(text string) string {
-	cols, err := strconv.Atoi(os.Getenv("OVERLAID_WINDOW_COLS"))
-	if err == nil {
-		return convert_text(text, cols)
+// ConvertText converts text, such as the contents of a window with escape
+// codes, wrapped to cols columns, into the format needed by FindMarks
+func ConvertText(text string, cols int) string {
+	return convert_text(text, cols)
+}
+
+// ANSI_ESCAPE_PATTERN matches CSI, OSC and other escape codes
+const ANSI_ESCAPE_PATTERN = "\x1b(?:\\[[0-?]*[ -/]*[@-~]|\\][^\a\x1b]*(?:\x1b\\\\|\a)|[()*+][0-9A-Za-z]|[ -/]*[0-~])"
+
+// strip_ansi removes all escape codes from text, other than OSC 8 hyperlinks
+func strip_ansi(text string) string {
+	return utils.MustCompile(ANSI_ESCAPE_PATTERN).ReplaceAllStringFunc(text, func(x string) string {
+		if strings.HasPrefix(x, "\x1b]8;") {
+			return x
+		}
+		return ""
+	})
+}
+
+// overlaid_window_cols returns the width of the window being hinted, from the
+// value of the OVERLAID_WINDOW_COLS environment variable, if it is valid
+func overlaid_window_cols(val string) (int, bool) {
+	cols, err := strconv.Atoi(val)
+	return cols, err == nil && cols > 0
+}
+
+func parse_input(text string, tab_width int, strip_escape_codes bool) string {
+	if strip_escape_codes {
+		text = strip_ansi(text)
+	}
+	if cols, ok := overlaid_window_cols(os.Getenv("OVERLAID_WINDOW_COLS")); ok {
+		return convert_text_with_tab_width(text, cols, tab_width)
 	}
 	term, err := tty.OpenControllingTerm()
 	if err == nil {
 		sz, err := term.GetSize()
 		term.Close()
 		if err == nil {
-			return convert_text(text, int(sz.Col))
+			return convert_text_with_tab_width(text, int(sz.Col), tab_width)
 		}
 	}
-	return convert_text(text, 80)
+	return convert_text_with_tab_width(text, 80, tab_width)
 }
 
 type Result struct {
@@ -88,11 +152,197 @@ type Result struct {
 	Extra_cli_args       []string         `json:"extra_cli_args"`
 	Linenum_action       string           `json:"linenum_action"`
 	Cwd                  string           `json:"cwd"`
+	Matches_by_line      map[int][]string `json:"matches_by_line,omitempty"`
+	Copied_to_clipboard  bool             `json:"copied_to_clipboard,omitempty"`
+	Background           bool             `json:"background"`
+	Match_action         string           `json:"match_action"`
+	// The action for each match, one of the MARK_ACTION_* values
+	Actions []string `json:"actions"`
+	// The start and end byte offsets of each match in the text with escape
+	// codes removed and the one based line and column (in cells) of its start,
+	// null for matches not in the text, such as those recalled from history
+	Offsets   []*[2]int `json:"offsets"`
+	Positions []*[2]int `json:"positions"`
+}
+
+// line_number_at returns the one based number of the input line containing
+// the specified offset into text as returned by convert_text()
+func line_number_at(text string, offset int) int {
+	return strings.Count(text[:offset], "\n") + 1
+}
+
+// position_at returns the one based line and column, in cells, of the
+// specified offset into text as returned by convert_text()
+func position_at(text string, offset int) (line, col int) {
+	line_start := strings.LastIndexByte(text[:offset], '\n') + 1
+	return line_number_at(text, offset), wcswidth.Stringwidth(strings.ReplaceAll(text[line_start:offset], "\r", "")) + 1
+}
+
+// encode_hint returns the hint for num, left padded with the first character
+// of alphabet to at least min_length characters
+func encode_hint(num int, alphabet string, min_length int) string {
+	res := EncodeHint(num, alphabet)
+	if n := utf8.RuneCountInString(res); n < min_length {
+		first, _ := utf8.DecodeRuneInString(alphabet)
+		res = strings.Repeat(string(first), min_length-n) + res
+	}
+	return res
+}
+
+// trim_trailing_blanks removes the blank space and NUL padding at the end of
+// text, as returned by convert_text(), but never any part of a mark
+func trim_trailing_blanks(text string, marks []Mark) string {
+	floor := 0
+	for _, m := range marks {
+		floor = max(floor, min(m.End, len(text)))
+	}
+	return text[:floor] + strings.TrimRightFunc(text[floor:], func(r rune) bool { return r == 0 || unicode.IsSpace(r) })
+}
+
+// splice_marks returns text with the text of every mark replaced by the
+// result of replace, unless replace returns false. marks must be in order of
+// position, marks that overlap a previous mark are left unchanged.
+func splice_marks(text string, marks []Mark, replace func(m *Mark, mark_text string) (string, bool)) string {
+	buf := strings.Builder{}
+	buf.Grow(2 * len(text))
+	pos := 0
+	for i := range marks {
+		m := &marks[i]
+		if m.Start < pos {
+			continue
+		}
+		if r, ok := replace(m, text[m.Start:m.End]); ok {
+			buf.WriteString(text[pos:m.Start])
+			buf.WriteString(r)
+			pos = m.End
+		}
+	}
+	buf.WriteString(text[pos:])
+	return buf.String()
 }
 
-func encode_hint(num int, alphabet string) (res string) {
+// hint_cache caches the hints for mark numbers, as they are needed for every
+// mark on every render and key press
+type hint_cache struct {
+	alphabet   string
+	min_length int
+	hints      map[int]string
+}
+
+func (self *hint_cache) hint(num int, alphabet string) string {
+	if self.hints == nil || alphabet != self.alphabet {
+		self.alphabet, self.hints = alphabet, make(map[int]string, 64)
+	}
+	ans, found := self.hints[num]
+	if !found {
+		ans = encode_hint(num, alphabet, self.min_length)
+		self.hints[num] = ans
+	}
+	return ans
+}
+
+// expand_alphabet appends characters from extra that are not already present
+// in alphabet until it has at least size characters or extra is exhausted
+func expand_alphabet(alphabet, extra string, size int) string {
+	runes := []rune(alphabet)
+	for _, ch := range extra {
+		if len(runes) >= size {
+			break
+		}
+		if !slices.Contains(runes, ch) {
+			runes = append(runes, ch)
+		}
+	}
+	return string(runes)
+}
+
+// exclude_characters returns alphabet without any of the characters in chars
+func exclude_characters(alphabet, chars string) string {
+	return strings.Map(func(ch rune) rune { return utils.IfElse(strings.ContainsRune(chars, ch), -1, ch) }, alphabet)
+}
+
+// validate_alphabet checks that the alphabet can be used to encode hints
+// unambiguously
+func validate_alphabet(alphabet string) error {
+	seen := utils.NewSet[rune](len(alphabet))
+	for _, ch := range alphabet {
+		if seen.Has(ch) {
+			return fmt.Errorf("The hint alphabet contains the character %#v more than once", string(ch))
+		}
+		seen.Add(ch)
+	}
+	if seen.Len() < 2 {
+		return fmt.Errorf("The hint alphabet %#v must contain at least two different characters", alphabet)
+	}
+	return nil
+}
+
+// fold_alphabet lowercases alphabet, removing characters that become
+// duplicates, for case insensitive hints
+func fold_alphabet(alphabet string) string {
+	return expand_alphabet("", strings.ToLower(alphabet), utf8.RuneCountInString(alphabet))
+}
+
+// expand_badge_template replaces {name} in template with the value of name
+// from the groupdict of the mark or the type of the mark
+func expand_badge_template(template string, m *Mark, mark_type string) string {
+	return utils.MustCompile(`\{(\w+)\}`).ReplaceAllStringFunc(template, func(x string) string {
+		key := x[1 : len(x)-1]
+		if v, found := m.Groupdict[key]; found && v != nil {
+			return fmt.Sprint(v)
+		}
+		if key == "type" {
+			return mark_type
+		}
+		return ""
+	})
+}
+
+// expand_title_template replaces {type}, {count} and {remaining} in the
+// window title template, leaving anything else unchanged
+func expand_title_template(template, mark_type string, count, remaining int) string {
+	return utils.MustCompile(`\{(type|count|remaining)\}`).ReplaceAllStringFunc(template, func(x string) string {
+		switch x[1 : len(x)-1] {
+		case "type":
+			return mark_type
+		case "count":
+			return strconv.Itoa(count)
+		default:
+			return strconv.Itoa(remaining)
+		}
+	})
+}
+
+// Hints returns the hints that the kitten would display for count marks
+// numbered from zero, using the specified alphabet. An empty alphabet means the
+// default alphabet. Alphabets with less than two characters cannot be used to
+// encode hints and result in nil.
+func Hints(count int, alphabet string) []string {
+	if alphabet == "" {
+		alphabet = DEFAULT_HINT_ALPHABET
+	}
+	if count < 1 || utf8.RuneCountInString(alphabet) < 2 {
+		return nil
+	}
+	ans := make([]string, count)
+	for i := range ans {
+		ans[i] = EncodeHint(i, alphabet)
+	}
+	return ans
+}
+
+// EncodeHint returns the hint for the mark numbered num, using the specified
+// alphabet, which must have at least two characters. An empty alphabet means
+// the default alphabet.
+func EncodeHint(num int, alphabet string) (res string) {
+	if alphabet == "" {
+		alphabet = DEFAULT_HINT_ALPHABET
+	}
 	runes := []rune(alphabet)
 	d := len(runes)
+	if d < 2 {
+		return ""
+	}
 	for res == "" || num > 0 {
 		res = string(runes[num%d]) + res
 		num /= d
@@ -100,71 +350,647 @@ func encode_hint(num int, alphabet string) (res string) {
 	return
 }
 
-func decode_hint(x string, alphabet string) (ans int) {
-	base := len(alphabet)
-	index_map := make(map[rune]int, len(alphabet))
-	for i, c := range alphabet {
-		index_map[c] = i
+// DecodeHint is the inverse of EncodeHint, returning the number of the mark
+// for hint. An empty alphabet means the default alphabet. Hints padded with
+// the first character of the alphabet, as with --min-hint-length, decode to
+// the same number. Returns an error if hint contains characters not in the
+// alphabet.
+func DecodeHint(hint, alphabet string) (ans int, err error) {
+	if alphabet == "" {
+		alphabet = DEFAULT_HINT_ALPHABET
+	}
+	base := utf8.RuneCountInString(alphabet)
+	if hint == "" {
+		return 0, fmt.Errorf("Cannot decode an empty hint")
 	}
-	for _, char := range x {
-		ans = ans*base + index_map[char]
+	for _, char := range hint {
+		idx := strings.IndexRune(alphabet, char)
+		if idx < 0 {
+			return 0, fmt.Errorf("The hint %#v contains the character %#v which is not in the hint alphabet", hint, string(char))
+		}
+		ans = ans*base + utf8.RuneCountInString(alphabet[:idx])
 	}
 	return
 }
 
+// match_record is a single selected match, as output by --output-format=jsonl
+// and --stream-fd, which also includes the action
+type match_record struct {
+	Match     string         `json:"match"`
+	Groupdict map[string]any `json:"groupdict"`
+	Action    string         `json:"action,omitempty"`
+}
+
+// write_jsonl writes every selected match in result to w as a separate JSON
+// object on its own line
+func write_jsonl(w io.Writer, result *Result) error {
+	enc := json.NewEncoder(w)
+	for i, m := range result.Match {
+		if err := enc.Encode(match_record{Match: m, Groupdict: result.Groupdicts[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write_output_file writes data to path atomically if path is a regular file,
+// special files such as FIFOs are written to directly
+func write_output_file(path string, data []byte) error {
+	path = utils.Expanduser(path)
+	if s, err := os.Stat(path); err == nil && !s.Mode().IsRegular() {
+		return os.WriteFile(path, data, 0o600)
+	}
+	return utils.AtomicUpdateFile(path, bytes.NewReader(data), 0o600)
+}
+
+// history_mark returns the mark for text recalled from history, which is not
+// in the current text, so the mark has no position in it
+func history_mark(text string) *Mark {
+	return &Mark{Index: -1, Text: text, Groupdict: map[string]any{"from_history": true}}
+}
+
+// add_chosen_to_result sets the fields of result describing every chosen
+// mark. Marks from history have a negative index and no position in text, so
+// they have no offsets or positions and are not grouped by line.
+func add_chosen_to_result(result *Result, chosen []*Mark, text string, output_for func(*Mark) string, group_by_line bool) {
+	result.Match = make([]string, len(chosen))
+	result.Groupdicts = make([]map[string]any, len(chosen))
+	result.Offsets = make([]*[2]int, len(chosen))
+	result.Positions = make([]*[2]int, len(chosen))
+	result.Actions = make([]string, len(chosen))
+	for i, m := range chosen {
+		result.Match[i] = output_for(m)
+		result.Actions[i] = m.action()
+		result.Groupdicts[i] = m.Groupdict
+		if m.Index >= 0 {
+			line, col := position_at(text, m.Start)
+			result.Offsets[i] = &[2]int{m.Start, m.End}
+			result.Positions[i] = &[2]int{line, col}
+		}
+	}
+	if group_by_line {
+		result.Matches_by_line = make(map[int][]string, len(chosen))
+		for i, m := range chosen {
+			if m.Index >= 0 {
+				line := line_number_at(text, m.Start)
+				result.Matches_by_line[line] = append(result.Matches_by_line[line], result.Match[i])
+			}
+		}
+	}
+}
+
+// filter_matches returns true if the text of a mark survives the filter,
+// containing it, or starting with it in text entry mode, see --text-entry
+func filter_matches(text, filter string, text_entry, case_insensitive bool) bool {
+	if !text_entry {
+		return strings.Contains(strings.ToLower(text), strings.ToLower(filter))
+	}
+	if case_insensitive {
+		text, filter = strings.ToLower(text), strings.ToLower(filter)
+	}
+	return strings.HasPrefix(text, filter)
+}
+
+// format_match returns the text of a chosen match as output, shell quoted if
+// requested, with suffix added after any quoting
+func format_match(text, suffix string, shell_quote bool) string {
+	if shell_quote {
+		text = shlex.Quote(text)
+	}
+	return text + suffix
+}
+
+// The maximum number of entries in the history of selected text for each type
+const HISTORY_SIZE = 25
+
+type HistoryData struct {
+	Recent map[string][]string `json:"recent"`
+}
+
+// add_to_history returns recent with text moved to the front, keeping at most
+// HISTORY_SIZE entries
+func add_to_history(recent []string, text string) []string {
+	ans := make([]string, 0, len(recent)+1)
+	ans = append(ans, text)
+	for _, x := range recent {
+		if x != text && len(ans) < HISTORY_SIZE {
+			ans = append(ans, x)
+		}
+	}
+	return ans
+}
+
+// sort_chosen returns the chosen marks sorted as specified by --sort-output,
+// either by position in the text or by text, otherwise in the order they were
+// chosen
+func sort_chosen(chosen []*Mark, how string) []*Mark {
+	var cmp func(a, b *Mark) int
+	switch how {
+	case "position":
+		cmp = func(a, b *Mark) int { return a.Start - b.Start }
+	case "text":
+		cmp = func(a, b *Mark) int { return strings.Compare(a.Text, b.Text) }
+	default:
+		return chosen
+	}
+	ans := slices.Clone(chosen)
+	slices.SortStableFunc(ans, cmp)
+	return ans
+}
+
+// clipboard_text returns the text copied by --copy-to-clipboard, the chosen
+// marks that are selected joined by --multiple-joiner, or "" if there are none
+func clipboard_text(chosen []*Mark, o *Options, output_for func(*Mark) string) string {
+	matches := make([]string, 0, len(chosen))
+	for _, m := range sort_chosen(chosen, o.SortOutput) {
+		if m.action() == MARK_ACTION_SELECT {
+			matches = append(matches, output_for(m))
+		}
+	}
+	return join_matches(matches, o.MultipleJoiner, o.Type)
+}
+
+// copy_escape_code returns the OSC 52 escape code to copy text to the
+// clipboard, or the primary selection if target is primary
+func copy_escape_code(text, target string) string {
+	dest := utils.IfElse(target == "primary", "p", "c")
+	return "\x1b]52;" + dest + ";" + base64.StdEncoding.EncodeToString(utils.UnsafeStringToBytes(text)) + "\x1b\\"
+}
+
+// join_matches joins matches the same way as the Python side does for
+// --multiple-joiner when copying or inserting text
+func join_matches(matches []string, joiner, text_type string) string {
+	if len(matches) == 0 {
+		return ""
+	}
+	if idx, err := strconv.Atoi(joiner); err == nil {
+		if idx < 0 {
+			idx += len(matches)
+		}
+		if idx < 0 || idx >= len(matches) {
+			idx = len(matches) - 1
+		}
+		return matches[idx]
+	}
+	switch joiner {
+	case "json":
+		b, _ := json.MarshalIndent(matches, "", "\t")
+		return string(b)
+	case "auto":
+		return strings.Join(matches, utils.IfElse(text_type == "line" || text_type == "url", "\n\r", " "))
+	case "newline":
+		return strings.Join(matches, "\n\r")
+	case "space":
+		return strings.Join(matches, " ")
+	case "empty":
+		return strings.Join(matches, "")
+	}
+	return strings.Join(matches, joiner)
+}
+
+// unescape_joiner replaces the escapes \n, \t, \r, \0 and \\ in a
+// --multiple-joiner value with the characters they represent
+func unescape_joiner(joiner string) string {
+	if !strings.Contains(joiner, `\`) {
+		return joiner
+	}
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\t`, "\t", `\r`, "\r", `\0`, "\x00").Replace(joiner)
+}
+
+// overlay_hint draws hint over the leading cells of mark_text, returning the
+// drawn hint and the rest of mark_text. Hint characters cover as many
+// characters of mark_text as needed to occupy the same number of cells, with
+// any left over cells padded with spaces. Line breaks are kept and any hint
+// characters left over are drawn after the mark.
+func overlay_hint(hint, mark_text string) (drawn, rest string) {
+	h := wcswidth.SplitIntoGraphemes(hint)
+	buf := strings.Builder{}
+	buf.Grow(2 * len(hint))
+	graphemes := wcswidth.SplitIntoGraphemes(mark_text)
+	// the number of cells of mark_text covered so far and the number of cells
+	// of hint drawn so far
+	covered, drawn_cells := 0, 0
+	i := 0
+	for ; i < len(graphemes) && len(h) > 0; i++ {
+		g := graphemes[i]
+		if g == "\r" || g == "\n" {
+			if drawn_cells < covered {
+				// a wide hint character that did not fit draws over the end of the line
+				buf.WriteString(h[0])
+				h = h[1:]
+				drawn_cells = covered
+			}
+			buf.WriteString("\n")
+			continue
+		}
+		covered += wcswidth.Stringwidth(g)
+		for len(h) > 0 && drawn_cells+wcswidth.Stringwidth(h[0]) <= covered {
+			buf.WriteString(h[0])
+			drawn_cells += wcswidth.Stringwidth(h[0])
+			h = h[1:]
+		}
+	}
+	if len(h) > 0 {
+		buf.WriteString(strings.Join(h, ""))
+	} else if covered > drawn_cells {
+		buf.WriteString(strings.Repeat(" ", covered-drawn_cells))
+	}
+	return buf.String(), strings.Join(graphemes[i:], "")
+}
+
+// overlay_hint_at_end is like overlay_hint except that the hint is drawn over
+// the trailing cells of mark_text, with the rest of mark_text preceding it
+func overlay_hint_at_end(hint, mark_text string) (drawn, rest string) {
+	graphemes := wcswidth.SplitIntoGraphemes(mark_text)
+	needed, i := wcswidth.Stringwidth(hint), len(graphemes)
+	for i > 0 && needed > 0 {
+		i--
+		needed -= wcswidth.Stringwidth(graphemes[i])
+	}
+	drawn, _ = overlay_hint(hint, strings.Join(graphemes[i:], ""))
+	return drawn, strings.Join(graphemes[:i], "")
+}
+
+// how long to wait for further input before choosing a complete hint that
+// is also a prefix of other hints, see --prefix-conflict
+const PREFIX_CONFLICT_TIMEOUT = 500 * time.Millisecond
+
+// newly revealed marks are flashed for FLASH_TICKS redraws FLASH_INTERVAL
+// apart, see --flash-new
+const (
+	FLASH_TICKS    = 2
+	FLASH_INTERVAL = 150 * time.Millisecond
+)
+
+// holding down a navigation key moves by more than one match at a time after
+// NAVIGATION_ACCELERATION_DELAY repeats, by one more every
+// NAVIGATION_ACCELERATION_RATE repeats, up to NAVIGATION_MAX_STEP
+const (
+	NAVIGATION_ACCELERATION_DELAY = 10
+	NAVIGATION_ACCELERATION_RATE  = 5
+	NAVIGATION_MAX_STEP           = 8
+)
+
+// navigation_step returns the number of matches to move by for a navigation
+// key that has been repeated the specified number of times
+func navigation_step(repeats int) int {
+	if repeats < NAVIGATION_ACCELERATION_DELAY {
+		return 1
+	}
+	return min(NAVIGATION_MAX_STEP, 2+(repeats-NAVIGATION_ACCELERATION_DELAY)/NAVIGATION_ACCELERATION_RATE)
+}
+
+// move_selection returns the position of the selection moved by step, which
+// is negative to move up, among count positions. Single steps wrap around,
+// larger steps stop at the first and last positions, so that holding down a
+// key does not race past them. A negative position is no selection.
+func move_selection(position, count, step int) int {
+	if position < 0 {
+		position = utils.IfElse(step > 0, -1, count)
+	}
+	if step == 1 || step == -1 {
+		return (position + step + count) % count
+	}
+	return max(0, min(count-1, position+step))
+}
+
+// The number of rows scrolled by a mouse wheel event, for text taller than the screen
+const WHEEL_SCROLL_ROWS = 3
+
+// visible_rows returns the rows of text to display on a screen with height
+// rows, scrolled back scroll_back rows from the bottom and the row of text at
+// the top of the screen. scroll_back is clamped to the valid range.
+func visible_rows(rows []string, height, scroll_back int) (ans []string, top int) {
+	if height < 1 || len(rows) <= height {
+		return rows, 0
+	}
+	top = len(rows) - height - max(0, min(scroll_back, len(rows)-height))
+	return rows[top : top+height], top
+}
+
+// page_target returns the position in rows, the nondecreasing rows of the
+// marks in order, of the mark about one page of page rows away from the mark
+// at current, moving down for positive page and up for negative page. It
+// moves by at least one mark and stays within rows.
+func page_target(rows []int, current, page int) int {
+	if len(rows) == 0 {
+		return current
+	}
+	target := rows[current] + page
+	if page > 0 {
+		ans := min(current+1, len(rows)-1)
+		for ans+1 < len(rows) && rows[ans+1] <= target {
+			ans++
+		}
+		return ans
+	}
+	ans := max(current-1, 0)
+	for ans > 0 && rows[ans-1] >= target {
+		ans--
+	}
+	return ans
+}
+
+// number_filter_survivors returns the positions used for the hints of the
+// marks that match a filter, numbered from offset in index order. Marks in
+// ignored, such as those already chosen, are skipped, so the filter only
+// affects the marks still on offer.
+func number_filter_survivors(index_map map[int]*Mark, ignored *utils.Set[int], offset int, matches func(*Mark) bool) map[int]int {
+	survivors := []*Mark{}
+	for idx, m := range index_map {
+		if !ignored.Has(idx) && matches(m) {
+			survivors = append(survivors, m)
+		}
+	}
+	slices.SortFunc(survivors, func(a, b *Mark) int { return a.Index - b.Index })
+	ans := make(map[int]int, len(survivors))
+	for i, m := range survivors {
+		ans[m.Index] = offset + i
+	}
+	return ans
+}
+
+// mark_at_cell returns the index of the mark displayed at the specified zero
+// based column (in cells) of row, a row of the rendered screen, in which marks
+// are hyperlinks of the form prefix<index>, or -1 if there is none. Working
+// from the rendered row means hints, badges and the like are accounted for.
+func mark_at_cell(row string, col int, prefix string) int {
+	if col < 0 {
+		return -1
+	}
+	x, active := 0, -1
+	cell_at := func(text string) bool {
+		for _, g := range wcswidth.SplitIntoGraphemes(text) {
+			if w := wcswidth.Stringwidth(g); w > 0 {
+				if col < x+w {
+					return true
+				}
+				x += w
+			}
+		}
+		return false
+	}
+	pos := 0
+	for _, r := range utils.MustCompile(ANSI_ESCAPE_PATTERN).FindAllStringIndex(row, -1) {
+		if cell_at(row[pos:r[0]]) {
+			return active
+		}
+		pos = r[1]
+		if code := row[r[0]:r[1]]; strings.HasPrefix(code, "\x1b]8;") {
+			// the URL follows the params, ending at the terminator
+			_, url, _ := strings.Cut(strings.TrimRight(code[4:], "\a\x1b\\"), ";")
+			active = -1
+			if idx, err := strconv.Atoi(strings.TrimPrefix(url, prefix)); err == nil && strings.HasPrefix(url, prefix) {
+				active = idx
+			}
+		}
+	}
+	if cell_at(row[pos:]) {
+		return active
+	}
+	return -1
+}
+
+var VIM_KEYS = map[string]string{"j": "next", "k": "prev", "g": "first", "G": "last"}
+
+// DEFAULT_KEY_BINDINGS maps the actions that can be bound with
+// --key-bindings to their default keys
+var DEFAULT_KEY_BINDINGS = map[string][]string{
+	"next":       {"down", "tab"},
+	"prev":       {"up", "shift+tab"},
+	"page_down":  {"page_down"},
+	"page_up":    {"page_up"},
+	"first":      {"home"},
+	"last":       {"end"},
+	"select":     {"enter", "kp_enter", "space"},
+	"close":      {"delete"},
+	"quit":       {"esc"},
+	"focus":      {"ctrl+space"},
+	"peek":       {"ctrl+p"},
+	"select_all": {"ctrl+a"},
+	"undo":       {"ctrl+z"},
+}
+
+// key_bindings returns the keys bound to each action, the defaults with the
+// keys of any action in bindings, of the form action:keys, replaced
+func key_bindings(bindings []string) (map[string][]string, error) {
+	ans := make(map[string][]string, len(DEFAULT_KEY_BINDINGS))
+	for action, keys := range DEFAULT_KEY_BINDINGS {
+		ans[action] = keys
+	}
+	for _, x := range bindings {
+		action, keys, found := strings.Cut(x, ":")
+		action = strings.TrimSpace(action)
+		if _, known := DEFAULT_KEY_BINDINGS[action]; !found || !known {
+			actions := utils.Keys(DEFAULT_KEY_BINDINGS)
+			slices.Sort(actions)
+			return nil, fmt.Errorf("Invalid --key-bindings value: %#v, must be of the form action:keys with action one of: %s", x, strings.Join(actions, ", "))
+		}
+		ans[action] = strings.Fields(keys)
+	}
+	return ans, nil
+}
+
+// keypad_digit returns the digit for a numeric keypad key, distinct from the
+// digits in the number row, which are delivered as text
+func keypad_digit(key string) (string, bool) {
+	if d, found := strings.CutPrefix(key, "KP_"); found && len(d) == 1 && d[0] >= '0' && d[0] <= '9' {
+		return d, true
+	}
+	return "", false
+}
+
+// format_event_log formats a single line for the --log-keys file
+func format_event_log(when time.Time, kind, event, action string) string {
+	return fmt.Sprintf("%s %s %s -> %s\n", when.Format(time.RFC3339Nano), kind, event, action)
+}
+
 func as_rgb(c uint32) [3]float32 {
 	return [3]float32{float32((c>>16)&255) / 255.0, float32((c>>8)&255) / 255.0, float32(c&255) / 255.0}
 }
 
-func hints_text_color(confval string) (ans string) {
+// auto_text_color picks whichever of color8 and color15 contrasts most with
+// the background, falling back to pure black or white if neither has a
+// contrast of at least min_contrast
+func auto_text_color(background, color8, color15 uint32, min_contrast float64) string {
+	bg := as_rgb(background)
+	contrast := func(c uint32) float64 {
+		x := as_rgb(c)
+		return float64(utils.RGBContrast(bg[0], bg[1], bg[2], x[0], x[1], x[2]))
+	}
+	c8, c15 := contrast(color8), contrast(color15)
+	if max(c8, c15) < min_contrast {
+		return utils.IfElse(contrast(0) > contrast(0xffffff), "#000000", "#ffffff")
+	}
+	return utils.IfElse(c8 > c15, "bright-black", "bright-gray")
+}
+
+func hints_text_color(confval string, min_contrast float64) (ans string) {
 	ans = confval
 	if ans == "auto" {
 		ans = "bright-gray"
 		if bc, err := tui.ReadBasicColors(); err == nil {
-			bg := as_rgb(bc.Background)
-			c15 := as_rgb(bc.Color15)
-			c8 := as_rgb(bc.Color8)
-			if utils.RGBContrast(bg[0], bg[1], bg[2], c8[0], c8[1], c8[2]) > utils.RGBContrast(bg[0], bg[1], bg[2], c15[0], c15[1], c15[2]) {
-				ans = "bright-black"
-			}
+			ans = auto_text_color(bc.Background, bc.Color8, bc.Color15, min_contrast)
 		}
 	}
 	return
 }
 
+// blend_colors returns the color a fraction t of the way from a to b, as
+// #rrggbb
+func blend_colors(a, b uint32, t float64) string {
+	ans := uint32(0)
+	for shift := 16; shift >= 0; shift -= 8 {
+		x, y := float64((a>>shift)&255), float64((b>>shift)&255)
+		ans |= uint32(math.Round(x+(y-x)*t)) << shift
+	}
+	return fmt.Sprintf("#%06x", ans)
+}
+
+// faint_style resolves the auto value of --faint-style to a foreground
+// half way between the window foreground and background
+func faint_style(spec string) string {
+	if spec != "auto" {
+		return spec
+	}
+	bc, err := tui.ReadBasicColors()
+	if err != nil {
+		return "dim"
+	}
+	return "fg=" + blend_colors(bc.Foreground, bc.Background, 0.5)
+}
+
+// hint_style_for_type returns the style for hints of the specified type,
+// using the first matching entry of type_colors, of the form type:spec, or
+// the specified colors if there is none
+func hint_style_for_type(type_colors []string, mark_type, fg, bg string) (string, error) {
+	for _, x := range type_colors {
+		t, spec, found := strings.Cut(x, ":")
+		if !found || strings.TrimSpace(spec) == "" {
+			return "", fmt.Errorf("Invalid --type-colors value: %#v, must be of the form type:style", x)
+		}
+		if strings.TrimSpace(t) == mark_type {
+			return strings.TrimSpace(spec) + " bold", nil
+		}
+	}
+	return fmt.Sprintf("fg=%s bg=%s bold", fg, bg), nil
+}
+
+// color_preview_style returns a hint style using the specified color, in the
+// form #rrggbb, as the background, with black or white text, whichever
+// contrasts most with it
+func color_preview_style(hex string) string {
+	c, err := strconv.ParseUint(strings.TrimPrefix(hex, "#")[:6], 16, 32)
+	if err != nil {
+		return ""
+	}
+	bg := as_rgb(uint32(c))
+	fg := utils.IfElse(utils.RGBContrast(bg[0], bg[1], bg[2], 0, 0, 0) > utils.RGBContrast(bg[0], bg[1], bg[2], 1, 1, 1), "#000000", "#ffffff")
+	return fmt.Sprintf("fg=%s bg=%s bold", fg, hex[:7])
+}
+
+// selected_colors resolves auto values for the colors of the selected item.
+// The background becomes a gray close to the window background and the
+// foreground whichever of the window foreground and background contrasts
+// most with it.
+func selected_colors(fg, bg string) (string, string) {
+	if fg != "auto" && bg != "auto" {
+		return fg, bg
+	}
+	bc, err := tui.ReadBasicColors()
+	if err != nil {
+		bc.Foreground, bc.Background = 0xdddddd, 0
+	}
+	contrast := func(a, b [3]float32) float32 {
+		return utils.RGBContrast(a[0], a[1], a[2], b[0], b[1], b[2])
+	}
+	if bg == "auto" {
+		bg = "#444444"
+		if window_bg := as_rgb(bc.Background); contrast(window_bg, as_rgb(0xcccccc)) < contrast(window_bg, as_rgb(0x444444)) {
+			bg = "#cccccc"
+		}
+	}
+	if fg == "auto" {
+		fg = ""
+		if c, err := style.ParseColor(bg); err == nil {
+			selected_bg := as_rgb(uint32(c.Red)<<16 | uint32(c.Green)<<8 | uint32(c.Blue))
+			fg = fmt.Sprintf("#%06x", utils.IfElse(contrast(selected_bg, as_rgb(bc.Foreground)) >= contrast(selected_bg, as_rgb(bc.Background)), bc.Foreground, bc.Background))
+		}
+	}
+	return fg, bg
+}
+
 func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
-	o.HintsTextColor = hints_text_color(o.HintsTextColor)
+	o.HintsTextColor = hints_text_color(o.HintsTextColor, o.MinContrast)
+	o.SelectedForegroundColor, o.SelectedBackgroundColor = selected_colors(o.SelectedForegroundColor, o.SelectedBackgroundColor)
 	output := tui.KittenOutputSerializer()
-	if tty.IsTerminal(os.Stdin.Fd()) {
-		return 1, fmt.Errorf("You must pass the text to be hinted on STDIN")
+	if o.OutputFormat == "jsonl" && tui.RunningAsUI() {
+		// inside kitty the result goes to the kitten result handler, not STDOUT
+		return 1, fmt.Errorf("--output-format=jsonl can only be used when running outside of kitty, use --output-file or --stream-fd instead")
 	}
-	stdin, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		return 1, fmt.Errorf("Failed to read from STDIN with error: %w", err)
+	var input []byte
+	if o.InputFile != "" {
+		if input, err = os.ReadFile(utils.Expanduser(o.InputFile)); err != nil {
+			return 1, fmt.Errorf("Failed to read the input file %#v with error: %w", o.InputFile, err)
+		}
+	} else {
+		if tty.IsTerminal(os.Stdin.Fd()) {
+			return 1, fmt.Errorf("You must pass the text to be hinted on STDIN or use --input-file")
+		}
+		if input, err = io.ReadAll(os.Stdin); err != nil {
+			return 1, fmt.Errorf("Failed to read from STDIN with error: %w", err)
+		}
 	}
-	if len(args) > 0 && o.CustomizeProcessing == "" && o.Type != "linenum" {
+	if len(args) > 0 && o.CustomizeProcessing == "" && o.Type != "linenum" && o.Type != "fileloc" && o.Type != "traceback" {
 		return 1, fmt.Errorf("Extra command line arguments present: %s", strings.Join(args, " "))
 	}
-	input_text := parse_input(utils.UnsafeBytesToString(stdin))
-	text, all_marks, index_map, err := find_marks(input_text, o, os.Args[2:]...)
+	input_text := parse_input(utils.UnsafeBytesToString(input), o.TabWidth, o.StripAnsi)
+	text, all_marks, index_map, dropped_count, err := find_marks(input_text, o, os.Args[2:]...)
 	if err != nil {
 		return 1, err
 	}
 
+	o.MultipleJoiner = unescape_joiner(o.MultipleJoiner)
 	result := Result{
 		Programs: o.Program, Multiple_joiner: o.MultipleJoiner, Customize_processing: o.CustomizeProcessing, Type: o.Type,
-		Extra_cli_args: args, Linenum_action: o.LinenumAction,
+		Extra_cli_args: args, Linenum_action: o.LinenumAction, Background: o.Background,
+		Match_action: o.MatchAction,
 	}
 	result.Cwd, _ = os.Getwd()
 	alphabet := o.Alphabet
 	if alphabet == "" {
 		alphabet = DEFAULT_HINT_ALPHABET
 	}
+	if err = validate_alphabet(alphabet); err != nil {
+		return 1, err
+	}
+	if o.AutoExpandAlphabet {
+		largest_index := 0
+		for idx := range index_map {
+			largest_index = max(largest_index, idx)
+		}
+		alphabet = expand_alphabet(alphabet, o.AlphabetExpansion, largest_index+1)
+	}
+	if o.CaseInsensitive {
+		alphabet = fold_alphabet(alphabet)
+	}
+	if o.ExcludeConfusables {
+		if alphabet = exclude_characters(alphabet, o.ConfusableCharacters); utf8.RuneCountInString(alphabet) < 2 {
+			return 1, fmt.Errorf("Too few characters remain in the hint alphabet after removing the confusable characters: %#v", o.ConfusableCharacters)
+		}
+	}
+	// keypad digits select hints using their own alphabet, see --numeric-keypad-hints
+	main_alphabet, keypad_mode := alphabet, false
 	ignore_mark_indices := utils.NewSet[int](8)
+	// indices of marks that have been selected, tracked separately from
+	// ignore_mark_indices so that they can be displayed regardless of filtering
+	chosen_indices := utils.NewSet[int](8)
+	// remaining redraw ticks for which newly revealed marks are flashed, see --flash-new
+	flash_ticks := map[int]int{}
 	window_title := o.WindowTitle
 	if window_title == "" {
 		switch o.Type {
-		case "url":
+		case "url", "markdown":
 			window_title = "Choose URL"
 		default:
 			window_title = "Choose text"
@@ -172,26 +998,67 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 	}
 	current_text := ""
 	current_input := ""
+	// the ordinal typed with --numeric-overlay, kept separate from the hint input
+	number_input := ""
 	match_suffix := ""
 	switch o.AddTrailingSpace {
 	case "always":
 		match_suffix = " "
 	case "never":
 	default:
-		if o.Multiple {
+		if o.Multiple && o.MatchAction != "scroll_to" {
 			match_suffix = " "
 		}
 	}
+	// the output for a chosen mark, its url named group for --match-action=open_url
+	output_for := func(m *Mark) string {
+		text := m.Text
+		if u, ok := m.Groupdict["url"].(string); ok && u != "" && o.MatchAction == "open_url" {
+			text = u
+		}
+		return format_match(text, match_suffix, o.ShellQuote)
+	}
 	chosen := []*Mark{}
 	lp, err := loop.New(loop.NoAlternateScreen) // no alternate screen reduces flicker on exit
 	if err != nil {
 		return
 	}
 	fctx := style.Context{AllowEscapeCodes: true}
-	faint := fctx.SprintFunc("dim")
-	hint_style := fctx.SprintFunc(fmt.Sprintf("fg=%s bg=%s bold", o.HintsForegroundColor, o.HintsBackgroundColor))
+	faint := fctx.SprintFunc(faint_style(o.FaintStyle))
+	hint_style_spec, err := hint_style_for_type(o.TypeColors, o.Type, o.HintsForegroundColor, o.HintsBackgroundColor)
+	if err != nil {
+		return 1, err
+	}
+	hint_style := fctx.SprintFunc(hint_style_spec)
+	bindings, err := key_bindings(o.KeyBindings)
+	if err != nil {
+		return 1, err
+	}
+	color_preview_styles := map[string]func(...any) string{}
+	// hint_style_for_mark previews the color captured by the color type
+	hint_style_for_mark := func(m *Mark) func(...any) string {
+		hex, _ := m.Groupdict["hex"].(string)
+		if o.Type != "color" || len(hex) < 7 {
+			return hint_style
+		}
+		s, found := color_preview_styles[hex]
+		if !found {
+			s = hint_style
+			if spec := color_preview_style(hex); spec != "" {
+				s = fctx.SprintFunc(spec)
+			}
+			color_preview_styles[hex] = s
+		}
+		return s
+	}
 	text_style := fctx.SprintFunc(fmt.Sprintf("fg=%s bold", o.HintsTextColor))
-	selected_style := fctx.SprintFunc("bg=#444444 bold") // Highlight selected item with gray background
+	emphasized_text_style := fctx.SprintFunc(fmt.Sprintf("fg=%s bold underline", o.HintsTextColor))
+	selected_style := fctx.SprintFunc(utils.IfElse(o.SelectedForegroundColor == "", "", "fg="+o.SelectedForegroundColor+" ") + "bg=" + o.SelectedBackgroundColor + " bold")
+	chosen_style := fctx.SprintFunc("reverse")
+	badge_style := fctx.SprintFunc(fmt.Sprintf("fg=%s bold", o.HintsBackgroundColor))
+	flash_style := fctx.SprintFunc("reverse bold")
+	count_style := fctx.SprintFunc(fmt.Sprintf("fg=%s bg=%s", o.HintsForegroundColor, o.HintsBackgroundColor))
+	fading_flash_style := fctx.SprintFunc("reverse dim")
 
 	// Build ordered list of indices for arrow navigation (sorted by position in text, not by index)
 	// This respects the visual order of tabs as displayed (which follows select_tab_sort_order)
@@ -225,6 +1092,22 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 	if selected_position == -1 && len(ordered_indices) > 0 {
 		selected_position = 0 // Default to first item if no ◄ found
 	}
+	ordinal_for := make(map[int]int, len(ordered_indices))
+	for i, idx := range ordered_indices {
+		ordinal_for[idx] = i + 1
+	}
+	// For text taller than the screen, the number of rows scrolled back from
+	// the bottom. The selected match is scrolled into view whenever the
+	// selection changes.
+	scroll_back, scrolled_to_position := 0, selected_position
+	row_starts := []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' || text[i] == '\r' {
+			row_starts = append(row_starts, i+1)
+		}
+	}
+	row_of_mark := func(m *Mark) int { return sort.SearchInts(row_starts, m.Start+1) - 1 }
+	ordered_rows := utils.Map(func(idx int) int { return row_of_mark(index_map[idx]) }, ordered_indices)
 
 	get_selected_index := func() int {
 		if selected_position >= 0 && selected_position < len(ordered_indices) {
@@ -233,90 +1116,358 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		return -1
 	}
 
+	// The live filter, see --filter-mode. While filtering, only marks whose
+	// text contains the filter text have hints, numbered from the start so
+	// that they stay short. Text entry mode is a filter that matches the start
+	// of the text, and is always active.
+	filter_mode, filter_text := o.FilterMode || o.TextEntry, ""
+	// Explicit focus selected with ctrl+space, either "navigate" where only
+	// the keyboard selection is used or "type" where only typed hints are.
+	// Empty means both are active.
+	focus := ""
+	var filter_positions map[int]int
+	hints := hint_cache{min_length: o.MinHintLength}
+	hint_for := func(m *Mark) (string, bool) {
+		if filter_positions == nil {
+			return hints.hint(m.Index, alphabet), true
+		}
+		pos, found := filter_positions[m.Index]
+		return hints.hint(pos, alphabet), found
+	}
+	mark_for_hint := func(hint string) *Mark {
+		for _, m := range index_map {
+			if h, ok := hint_for(m); ok && h == hint {
+				return m
+			}
+		}
+		return nil
+	}
+	apply_filter := func() {
+		current_input = ""
+		current_text = ""
+		filter_positions = nil
+		if filter_text == "" {
+			return
+		}
+		filter_positions = number_filter_survivors(index_map, ignore_mark_indices, max(0, o.HintsOffset), func(m *Mark) bool {
+			return filter_matches(m.Text, filter_text, o.TextEntry, o.CaseInsensitive)
+		})
+		if _, found := filter_positions[get_selected_index()]; !found {
+			for pos, idx := range ordered_indices {
+				if _, found := filter_positions[idx]; found {
+					selected_position = pos
+					break
+				}
+			}
+		}
+	}
+
 	highlight_mark := func(m *Mark, mark_text string) string {
-		hint := encode_hint(m.Index, alphabet)
-		if current_input != "" && !strings.HasPrefix(hint, current_input) {
+		hint, has_hint := hint_for(m)
+		if !has_hint || (current_input != "" && !strings.HasPrefix(hint, current_input)) {
+			if o.TypingEmphasis == "highlight-matches" {
+				return mark_text
+			}
 			return faint(mark_text)
 		}
 		hint = hint[len(current_input):]
 		if hint == "" {
 			hint = " "
 		}
-		if len(mark_text) <= len(hint) {
-			mark_text = ""
+		hint_at_end := o.HintPosition == "end"
+		if hint_at_end {
+			hint, mark_text = overlay_hint_at_end(hint, mark_text)
 		} else {
-			replaced_text := mark_text[:len(hint)]
-			replaced_text = strings.ReplaceAll(replaced_text, "\r", "\n")
-			if strings.Contains(replaced_text, "\n") {
-				buf := strings.Builder{}
-				buf.Grow(2 * len(hint))
-				h := hint
-				parts := strings.Split(replaced_text, "\n")
-				for i, x := range parts {
-					if x != "" {
-						buf.WriteString(h[:len(x)])
-						h = h[len(x):]
-					}
-					if i != len(parts)-1 {
-						buf.WriteString("\n")
-					}
-				}
-				if h != "" {
-					buf.WriteString(h)
-				}
-				hint = buf.String()
+			hint, mark_text = overlay_hint(hint, mark_text)
+		}
+		join := func(hint, mark_text string) string {
+			if hint_at_end {
+				return mark_text + hint
 			}
-			mark_text = mark_text[len(hint):]
+			return hint + mark_text
 		}
 
 		// Apply selected highlighting if this is the keyboard-selected item
 		var ans string
-		if m.Index == get_selected_index() {
-			ans = selected_style(hint) + selected_style(mark_text)
+		if m.Index == get_selected_index() && focus != "type" {
+			ans = join(selected_style(hint), selected_style(mark_text))
+		} else if n := flash_ticks[m.Index]; n > 0 {
+			s := utils.IfElse(n > 1, flash_style, fading_flash_style)
+			ans = join(s(hint), s(mark_text))
+		} else if current_input != "" && o.TypingEmphasis == "highlight-matches" {
+			ans = join(hint_style_for_mark(m)(hint), emphasized_text_style(mark_text))
 		} else {
-			ans = hint_style(hint) + text_style(mark_text)
+			ans = join(hint_style_for_mark(m)(hint), text_style(mark_text))
 		}
-		return fmt.Sprintf("\x1b]8;;mark:%d\a%s\x1b]8;;\a", m.Index, ans)
+		return fmt.Sprintf("\x1b]8;;%s%d\a%s\x1b]8;;\a", o.HyperlinkPrefix, m.Index, ans)
 	}
 
 	render := func() string {
-		ans := text
-		for i := len(all_marks) - 1; i >= 0; i-- {
-			mark := &all_marks[i]
+		text := text
+		if !o.KeepTrailingNewlines {
+			// trailing blank lines are not displayed
+			text = trim_trailing_blanks(text, all_marks)
+		}
+		ans := splice_marks(text, all_marks, func(mark *Mark, mark_text string) (string, bool) {
+			// chosen marks are displayed as such whatever the filter
+			if o.StickySelection && chosen_indices.Has(mark.Index) {
+				return chosen_style(mark_text), true
+			}
 			if ignore_mark_indices.Has(mark.Index) {
-				continue
+				return "", false
 			}
-			mtext := highlight_mark(mark, ans[mark.Start:mark.End])
-			ans = ans[:mark.Start] + mtext + ans[mark.End:]
-		}
-		ans = strings.ReplaceAll(ans, "\x00", "")
-		return strings.TrimRightFunc(strings.NewReplacer("\r", "\r\n", "\n", "\r\n").Replace(ans), unicode.IsSpace)
+			mtext := highlight_mark(mark, mark_text)
+			if o.NumericOverlay {
+				if ordinal := strconv.Itoa(ordinal_for[mark.Index]); strings.HasPrefix(ordinal, number_input) {
+					mtext = badge_style(ordinal) + mtext
+				}
+			}
+			if o.Badge != "" {
+				if badge := expand_badge_template(o.Badge, mark, o.Type); badge != "" {
+					mtext = badge_style(badge) + mtext
+				}
+			}
+			return mtext, true
+		})
+		return strings.NewReplacer("\r", "\r\n", "\n", "\r\n").Replace(strings.ReplaceAll(ans, "\x00", ""))
 	}
 
+	// draw the number of remaining marks at the top right, see --show-count
+	remaining_count := func() (ans int) {
+		for idx := range index_map {
+			if !ignore_mark_indices.Has(idx) {
+				ans++
+			}
+		}
+		return
+	}
+	// show the number of matches, see --show-count, and of those dropped by
+	// --max-marks, at the top right
+	draw_count := func() {
+		sz, err := lp.ScreenSize()
+		if err != nil {
+			return
+		}
+		status := ""
+		switch {
+		case !o.ShowCount:
+			status = fmt.Sprintf(" %d more matches not shown ", dropped_count)
+		case dropped_count > 0:
+			status = fmt.Sprintf(" %d remaining / %d total, %d not shown ", remaining_count(), len(index_map), dropped_count)
+		default:
+			status = fmt.Sprintf(" %d remaining / %d total ", remaining_count(), len(index_map))
+		}
+		lp.SaveCursorPosition()
+		lp.MoveCursorTo(max(1, int(sz.WidthCells)-wcswidth.Stringwidth(status)+1), 1)
+		lp.QueueWriteString(count_style(status))
+		lp.RestoreCursorPosition()
+	}
+	// show the explicit focus at the top left, see ctrl+space
+	draw_focus := func() {
+		lp.SaveCursorPosition()
+		lp.MoveCursorTo(1, 1)
+		lp.QueueWriteString(count_style(utils.IfElse(focus == "navigate", " NAVIGATE ", " TYPE HINT ")))
+		lp.RestoreCursorPosition()
+	}
+	// draw_status_line draws text at the bottom of the screen, wrapped to as
+	// many rows as needed
+	draw_status_line := func(text string) {
+		sz, err := lp.ScreenSize()
+		if err != nil {
+			return
+		}
+		width, height := int(sz.WidthCells), int(sz.HeightCells)
+		status := " " + text + " "
+		rows := min(height, max(1, (wcswidth.Stringwidth(status)+width-1)/width))
+		status = wcswidth.TruncateToVisualLength(status, rows*width)
+		lp.SaveCursorPosition()
+		for y := height - rows + 1; y <= height; y++ {
+			lp.MoveCursorTo(1, y)
+			lp.ClearToEndOfLine()
+		}
+		lp.MoveCursorTo(1, height-rows+1)
+		lp.QueueWriteString(count_style(status))
+		lp.RestoreCursorPosition()
+	}
+	// show the full text of the keyboard selected match at the bottom of the
+	// screen, toggled by ctrl+p
+	peek := false
+	draw_peek := func() {
+		if m := index_map[get_selected_index()]; m != nil {
+			draw_status_line(m.Text)
+		}
+	}
+	// previously selected text, most recent first, recalled with ctrl+r, see
+	// --enable-history
+	var history []string
+	history_cache := utils.NewCachedValues("hints-history", &HistoryData{})
+	if o.EnableHistory {
+		history = history_cache.Load().Recent[o.Type]
+	}
+	history_pos := -1
+	screen_rows := func() []string {
+		rows := strings.Split(current_text, "\r\n")
+		sz, err := lp.ScreenSize()
+		if err != nil {
+			return rows
+		}
+		height := int(sz.HeightCells)
+		if len(rows) <= height {
+			scroll_back = 0
+			return rows
+		}
+		if selected_position != scrolled_to_position {
+			scrolled_to_position = selected_position
+			if m := index_map[get_selected_index()]; m != nil {
+				row := row_of_mark(m)
+				top := len(rows) - height - scroll_back
+				if row < top {
+					scroll_back += top - row
+				} else if row >= top+height {
+					scroll_back -= row - (top + height - 1)
+				}
+			}
+		}
+		visible, top := visible_rows(rows, height, scroll_back)
+		scroll_back = len(rows) - height - top
+		return visible
+	}
+	var update_flashes func()
+	// the window title is only sent when it changes
+	last_title := ""
+	update_title := func() {
+		title := expand_title_template(window_title, o.Type, len(index_map), remaining_count())
+		if filter_mode || filter_text != "" {
+			title += " /" + filter_text
+		}
+		if title != last_title {
+			last_title = title
+			lp.SetWindowTitle(title)
+		}
+	}
+	// the rows last drawn, used to find the mark under the mouse
+	var drawn_rows []string
 	draw_screen := func() {
 		lp.StartAtomicUpdate()
 		defer lp.EndAtomicUpdate()
+		update_title()
 		if current_text == "" {
+			if o.FlashNew {
+				update_flashes()
+			}
 			current_text = render()
 		}
 		lp.ClearScreen()
-		lp.QueueWriteString(current_text)
+		drawn_rows = screen_rows()
+		lp.QueueWriteString(strings.Join(drawn_rows, "\r\n"))
+		if o.ShowCount || dropped_count > 0 {
+			draw_count()
+		}
+		if history_pos > -1 {
+			draw_status_line("History: " + history[history_pos])
+		} else if o.TextEntry && filter_mode {
+			draw_status_line("Text: " + filter_text)
+		} else if peek {
+			draw_peek()
+		}
+		if focus != "" {
+			draw_focus()
+		}
+	}
+	scroll_by := func(rows int) {
+		scroll_back = max(0, scroll_back+rows)
+		draw_screen()
+	}
+	// marks drawn with a hint in the last render, used to detect newly revealed marks
+	var active_marks *utils.Set[int]
+	var flash_timer loop.IdType
+	update_flashes = func() {
+		now := utils.NewSet[int](len(all_marks))
+		for i := range all_marks {
+			m := &all_marks[i]
+			if h, ok := hint_for(m); ok && !ignore_mark_indices.Has(m.Index) && strings.HasPrefix(h, current_input) {
+				now.Add(m.Index)
+			}
+		}
+		if active_marks != nil {
+			for idx := range now.Iterable() {
+				if !active_marks.Has(idx) {
+					flash_ticks[idx] = FLASH_TICKS
+				}
+			}
+		}
+		active_marks = now
+		if len(flash_ticks) > 0 && flash_timer == 0 {
+			flash_timer, _ = lp.AddTimer(FLASH_INTERVAL, false, func(loop.IdType) error {
+				flash_timer = 0
+				for idx, n := range flash_ticks {
+					if n > 1 {
+						flash_ticks[idx] = n - 1
+					} else {
+						delete(flash_ticks, idx)
+					}
+				}
+				current_text = ""
+				draw_screen()
+				return nil
+			})
+		}
 	}
 	reset := func() {
 		current_input = ""
+		number_input = ""
+		current_text = ""
+		if filter_text != "" {
+			// renumber the filtered marks, as chosen marks take up no hints
+			apply_filter()
+		}
+	}
+	// Coalesce redraws caused by navigation, see --redraw-debounce
+	var redraw_timer loop.IdType
+	schedule_redraw := func() {
 		current_text = ""
+		if o.RedrawDebounce <= 0 {
+			draw_screen()
+			return
+		}
+		if redraw_timer == 0 {
+			redraw_timer, _ = lp.AddTimer(time.Duration(o.RedrawDebounce)*time.Millisecond, false, func(loop.IdType) error {
+				redraw_timer = 0
+				draw_screen()
+				return nil
+			})
+		}
+	}
+	// page moves the selection by a screen of rows, scrolling the text by the
+	// same amount, the selected match is then scrolled into view if needed
+	page := func(direction int) {
+		sz, err := lp.ScreenSize()
+		if err != nil {
+			return
+		}
+		height := int(sz.HeightCells)
+		if len(ordered_indices) > 0 {
+			selected_position = page_target(ordered_rows, selected_position, direction*height)
+		}
+		scroll_back = max(0, scroll_back-direction*height)
+		schedule_redraw()
 	}
 
 	lp.OnInitialize = func() (string, error) {
 		lp.SetCursorVisible(false)
-		lp.SetWindowTitle(window_title)
 		lp.AllowLineWrapping(false)
-		lp.MouseTrackingMode(loop.BUTTONS_ONLY_MOUSE_TRACKING)
+		lp.MouseTrackingMode(utils.IfElse(o.HoverHighlight, loop.FULL_MOUSE_TRACKING, loop.BUTTONS_ONLY_MOUSE_TRACKING))
 		draw_screen()
 		lp.SendOverlayReady()
 		return "", nil
 	}
 	lp.OnFinalize = func() string {
+		if o.CopyToClipboard && lp.ExitCode() == 0 {
+			if text := clipboard_text(chosen, o, output_for); text != "" {
+				lp.QueueWriteString(copy_escape_code(text, o.ClipboardTarget))
+				result.Copied_to_clipboard = true
+			}
+		}
 		lp.SetCursorVisible(true)
 		return ""
 	}
@@ -327,6 +1478,26 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 	// Handle right-click for closing tabs in select_tab
 	right_click_mode := false
 	lp.OnMouseEvent = func(ev *loop.MouseEvent) error {
+		if ev.Event_type == loop.MOUSE_PRESS && ev.Buttons&(loop.MOUSE_WHEEL_UP|loop.MOUSE_WHEEL_DOWN) != 0 {
+			scroll_by(utils.IfElse(ev.Buttons&loop.MOUSE_WHEEL_UP != 0, WHEEL_SCROLL_ROWS, -WHEEL_SCROLL_ROWS))
+			return nil
+		}
+		if ev.Event_type == loop.MOUSE_MOVE {
+			if o.HoverHighlight {
+				// select the hovered mark, only redrawing when it changes
+				if ev.Cell.Y >= 0 && ev.Cell.Y < len(drawn_rows) {
+					idx := mark_at_cell(drawn_rows[ev.Cell.Y], ev.Cell.X, o.HyperlinkPrefix)
+					if m := index_map[idx]; m != nil && !ignore_mark_indices.Has(idx) {
+						if pos, ok := ordinal_for[m.Index]; ok && pos-1 != selected_position {
+							selected_position = pos - 1
+							scrolled_to_position = selected_position
+							schedule_redraw()
+						}
+					}
+				}
+			}
+			return nil
+		}
 		if ev.Event_type == loop.MOUSE_RELEASE && ev.Buttons&loop.RIGHT_MOUSE_BUTTON != 0 {
 			// Right-click released - set flag, hyperlink click will follow
 			right_click_mode = true
@@ -354,10 +1525,7 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 			if m, ok := index_map[r.Mark]; ok {
 				if right_click_mode {
 					// Right-click on hyperlink - signal close action
-					// Use negative index to indicate close instead of select
-					m_copy := *m
-					m_copy.Index = -m.Index - 1 // Make negative and offset by 1 to differentiate from -0
-					chosen = append(chosen, &m_copy)
+					chosen = append(chosen, m.with_action(MARK_ACTION_CLOSE))
 					right_click_mode = false
 				} else {
 					// Regular left-click
@@ -365,6 +1533,7 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 				}
 				if o.Multiple {
 					ignore_mark_indices.Add(m.Index)
+					chosen_indices.Add(m.Index)
 					reset()
 				} else {
 					lp.Quit(0)
@@ -376,15 +1545,51 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		return nil
 	}
 
-	lp.OnText = func(text string, _, _ bool) error {
+	set_keypad_mode := func(on bool) {
+		if keypad_mode != on {
+			keypad_mode = on
+			alphabet = utils.IfElse(on, KEYPAD_HINT_ALPHABET, main_alphabet)
+			reset()
+		}
+	}
+
+	// choose_typed chooses the mark selected by typing its hint, returning
+	// false if the kitten is quitting
+	choose_typed := func(m *Mark) bool {
+		chosen = append(chosen, m)
+		if o.Multiple {
+			ignore_mark_indices.Add(m.Index)
+			chosen_indices.Add(m.Index)
+			reset()
+			return true
+		}
+		lp.Quit(0)
+		return false
+	}
+	var prefix_conflict_timer loop.IdType
+	// the number of times the key moving the selection has been repeated,
+	// for acceleration while it is held down
+	navigation_repeats := 0
+
+	handle_text := func(text string) error {
+		if focus == "navigate" {
+			return nil
+		}
+		if prefix_conflict_timer != 0 {
+			lp.RemoveTimer(prefix_conflict_timer)
+			prefix_conflict_timer = 0
+		}
 		changed := false
 		for _, ch := range text {
+			if o.CaseInsensitive {
+				ch = unicode.ToLower(ch)
+			}
 			if strings.ContainsRune(alphabet, ch) {
 				test_input := current_input + string(ch)
 				// Check if this input would match any valid hint
 				has_match := false
-				for idx := range index_map {
-					if eh := encode_hint(idx, alphabet); strings.HasPrefix(eh, test_input) {
+				for _, m := range index_map {
+					if eh, ok := hint_for(m); ok && strings.HasPrefix(eh, test_input) {
 						has_match = true
 						break
 					}
@@ -404,20 +1609,36 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		}
 		if changed {
 			matches := []*Mark{}
-			for idx, m := range index_map {
-				if eh := encode_hint(idx, alphabet); strings.HasPrefix(eh, current_input) {
+			for _, m := range index_map {
+				if eh, ok := hint_for(m); ok && strings.HasPrefix(eh, current_input) {
 					matches = append(matches, m)
 				}
 			}
-			if len(matches) == 1 {
-				chosen = append(chosen, matches[0])
-				if o.Multiple {
-					ignore_mark_indices.Add(matches[0].Index)
-					reset()
-				} else {
-					lp.Quit(0)
+			// the typed input can be a complete hint that is also a prefix of
+			// longer hints, see --prefix-conflict
+			var complete *Mark
+			if len(matches) > 1 {
+				complete = mark_for_hint(current_input)
+			}
+			var target *Mark
+			switch {
+			case len(matches) == 1:
+				target = matches[0]
+			case complete != nil && o.PrefixConflict == "immediate":
+				target = complete
+			case complete != nil && o.PrefixConflict == "timeout":
+				pending_input := current_input
+				prefix_conflict_timer, _ = lp.AddTimer(PREFIX_CONFLICT_TIMEOUT, false, func(loop.IdType) error {
+					prefix_conflict_timer = 0
+					if current_input == pending_input && choose_typed(complete) {
+						current_text = ""
+						draw_screen()
+					}
 					return nil
-				}
+				})
+			}
+			if target != nil && !choose_typed(target) {
+				return nil
 			}
 			current_text = ""
 			draw_screen()
@@ -425,8 +1646,135 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		return nil
 	}
 
+	update_filter := func(text string) {
+		filter_text = text
+		apply_filter()
+		if o.TextEntry && filter_mode && len(filter_positions) == 1 {
+			// the typed text identifies a single match, choose it
+			for idx := range filter_positions {
+				if !choose_typed(index_map[idx]) {
+					return
+				}
+			}
+			filter_text = ""
+			apply_filter()
+		}
+		draw_screen()
+	}
+
+	lp.OnText = func(text string, _, _ bool) error {
+		if filter_mode {
+			update_filter(filter_text + text)
+			return nil
+		}
+		if text == "/" && !strings.Contains(alphabet, text) {
+			filter_mode = true
+			update_filter(filter_text)
+			return nil
+		}
+		set_keypad_mode(false)
+		if o.NumericOverlay {
+			// digits are ordinals, everything else is hint input
+			rest := strings.Builder{}
+			for _, ch := range text {
+				if ch >= '0' && ch <= '9' {
+					number_input += string(ch)
+				} else {
+					rest.WriteRune(ch)
+				}
+			}
+			if rest.Len() < len(text) {
+				current_text = ""
+				draw_screen()
+			}
+			if text = rest.String(); text == "" {
+				return nil
+			}
+		}
+		return handle_text(text)
+	}
+
 	lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
-		if ev.MatchesPressOrRepeat("backspace") {
+		if filter_mode && (ev.Type == loop.PRESS || ev.Type == loop.REPEAT) {
+			switch {
+			case ev.MatchesPressOrRepeat("backspace"):
+				ev.Handled = true
+				if r := []rune(filter_text); len(r) > 0 {
+					update_filter(string(r[:len(r)-1]))
+				}
+				return nil
+			case ev.MatchesPressOrRepeat("enter") || ev.MatchesPressOrRepeat("kp_enter"):
+				// stop filtering, further input is hints
+				ev.Handled = true
+				filter_mode = false
+				if len(filter_positions) == 1 {
+					for idx := range filter_positions {
+						if !choose_typed(index_map[idx]) {
+							return nil
+						}
+					}
+				}
+				update_filter(filter_text)
+				return nil
+			case ev.Text != "":
+				// the text is delivered to OnText
+				return nil
+			}
+		}
+		if ev.MatchesPressOrRepeat("esc") && (filter_text != "" || (filter_mode && !o.TextEntry)) {
+			ev.Handled = true
+			filter_mode = o.TextEntry
+			update_filter("")
+			return nil
+		}
+		if ev.MatchesPressOrRepeat("ctrl+r") && len(history) > 0 {
+			ev.Handled = true
+			history_pos = (history_pos + 1) % len(history)
+			draw_screen()
+			return nil
+		}
+		if history_pos > -1 && (ev.MatchesPressOrRepeat("enter") || ev.MatchesPressOrRepeat("kp_enter")) {
+			ev.Handled = true
+			m := history_mark(history[history_pos])
+			history_pos = -1
+			if choose_typed(m) {
+				draw_screen()
+			}
+			return nil
+		}
+		if history_pos > -1 && ev.MatchesPressOrRepeat("esc") {
+			ev.Handled = true
+			history_pos = -1
+			draw_screen()
+			return nil
+		}
+		if o.NumericKeypadHints && (ev.Type == loop.PRESS || ev.Type == loop.REPEAT) {
+			if digit, ok := keypad_digit(ev.Key); ok {
+				ev.Handled = true
+				set_keypad_mode(true)
+				return handle_text(digit)
+			}
+		}
+		// vim style navigation keys, see --vim-keys
+		vim_key := ""
+		if o.VimKeys && (ev.Type == loop.PRESS || ev.Type == loop.REPEAT) && (current_input == "" || focus == "navigate" || !strings.Contains(alphabet, ev.Text)) {
+			vim_key = VIM_KEYS[ev.Text]
+		}
+		bound := func(action string) bool {
+			return vim_key == action || slices.ContainsFunc(bindings[action], ev.MatchesPressOrRepeat)
+		}
+		switch {
+		case ev.Type == loop.REPEAT && (bound("next") || bound("prev")):
+			navigation_repeats++
+		case ev.Type == loop.PRESS:
+			navigation_repeats = 0
+		}
+		if ev.MatchesPressOrRepeat("backspace") && number_input != "" {
+			ev.Handled = true
+			number_input = number_input[:len(number_input)-1]
+			current_text = ""
+			draw_screen()
+		} else if ev.MatchesPressOrRepeat("backspace") {
 			ev.Handled = true
 			r := []rune(current_input)
 			if len(r) > 0 {
@@ -441,77 +1789,46 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 				if idx >= 0 {
 					if m := index_map[idx]; m != nil {
 						// Mark this as a close action
-						m_copy := *m
-						if m_copy.Groupdict == nil {
-							m_copy.Groupdict = make(map[string]any)
-						}
-						m_copy.Groupdict["close_action"] = true
-						chosen = append(chosen, &m_copy)
+						chosen = append(chosen, m.with_action(MARK_ACTION_CLOSE))
 						lp.Quit(0)
 					}
 				}
 			}
-		} else if ev.MatchesPressOrRepeat("down") || ev.MatchesPressOrRepeat("tab") {
+		} else if bound("next") {
 			ev.Handled = true
-			// Move selection down (next item)
+			// Move selection down (next item), faster while the key is held
 			if len(ordered_indices) > 0 {
-				selected_position++
-				if selected_position >= len(ordered_indices) {
-					selected_position = 0 // Wrap to first
-				}
-				current_text = ""
-				draw_screen()
+				selected_position = move_selection(selected_position, len(ordered_indices), navigation_step(navigation_repeats))
+				schedule_redraw()
 			}
-		} else if ev.MatchesPressOrRepeat("up") || ev.MatchesPressOrRepeat("shift+tab") {
+		} else if bound("prev") {
 			ev.Handled = true
-			// Move selection up (previous item)
+			// Move selection up (previous item), faster while the key is held
 			if len(ordered_indices) > 0 {
-				selected_position--
-				if selected_position < 0 {
-					selected_position = len(ordered_indices) - 1 // Wrap to last
-				}
-				current_text = ""
-				draw_screen()
+				selected_position = move_selection(selected_position, len(ordered_indices), -navigation_step(navigation_repeats))
+				schedule_redraw()
 			}
-		} else if ev.MatchesPressOrRepeat("page_down") {
+		} else if bound("page_down") {
 			ev.Handled = true
-			// Jump down 3 items
-			if len(ordered_indices) > 0 {
-				selected_position += 3
-				if selected_position >= len(ordered_indices) {
-					selected_position = len(ordered_indices) - 1 // Stop at last
-				}
-				current_text = ""
-				draw_screen()
-			}
-		} else if ev.MatchesPressOrRepeat("page_up") {
+			page(1)
+		} else if bound("page_up") {
 			ev.Handled = true
-			// Jump up 3 items
-			if len(ordered_indices) > 0 {
-				selected_position -= 3
-				if selected_position < 0 {
-					selected_position = 0 // Stop at first
-				}
-				current_text = ""
-				draw_screen()
-			}
-		} else if ev.MatchesPressOrRepeat("home") {
+			page(-1)
+		} else if bound("first") {
 			ev.Handled = true
 			// Jump to first item
 			if len(ordered_indices) > 0 {
 				selected_position = 0
-				current_text = ""
-				draw_screen()
+				schedule_redraw()
 			}
-		} else if ev.MatchesPressOrRepeat("end") {
+		} else if bound("last") {
 			ev.Handled = true
 			// Jump to last item
 			if len(ordered_indices) > 0 {
 				selected_position = len(ordered_indices) - 1
-				current_text = ""
-				draw_screen()
+				schedule_redraw()
 			}
-		} else if ev.MatchesPressOrRepeat("delete") {
+		} else if bound("close") {
 			ev.Handled = true
 			// Clear any typed hint input first
 			current_input = ""
@@ -520,24 +1837,31 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 			idx := get_selected_index()
 			if idx >= 0 {
 				if m := index_map[idx]; m != nil {
-					// Mark this as a close action by adding a flag to groupdict
-					m_copy := *m
-					if m_copy.Groupdict == nil {
-						m_copy.Groupdict = make(map[string]any)
-					}
-					m_copy.Groupdict["close_action"] = true
-					chosen = append(chosen, &m_copy)
+					// Mark this as a close action
+					chosen = append(chosen, m.with_action(MARK_ACTION_CLOSE))
 					lp.Quit(0)
 				}
 			}
-		} else if ev.MatchesPressOrRepeat("enter") || ev.MatchesPressOrRepeat("space") {
+		} else if number_input != "" && (ev.MatchesPressOrRepeat("enter") || ev.MatchesPressOrRepeat("kp_enter")) {
+			ev.Handled = true
+			// User typed an ordinal, see --numeric-overlay
+			n, _ := strconv.Atoi(number_input)
+			number_input = ""
+			if n > 0 && n <= len(ordered_indices) {
+				if m := index_map[ordered_indices[n-1]]; m != nil && !ignore_mark_indices.Has(m.Index) && !choose_typed(m) {
+					return nil
+				}
+			}
+			current_text = ""
+			draw_screen()
+		} else if bound("select") {
 			ev.Handled = true
 			if current_input != "" {
 				// User typed a hint, use that
-				idx := decode_hint(current_input, alphabet)
-				if m := index_map[idx]; m != nil {
+				if m := mark_for_hint(current_input); m != nil {
 					chosen = append(chosen, m)
-					ignore_mark_indices.Add(idx)
+					ignore_mark_indices.Add(m.Index)
+					chosen_indices.Add(m.Index)
 					if o.Multiple {
 						reset()
 						draw_screen()
@@ -556,6 +1880,7 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 					if m := index_map[idx]; m != nil {
 						chosen = append(chosen, m)
 						ignore_mark_indices.Add(idx)
+						chosen_indices.Add(idx)
 						if o.Multiple {
 							reset()
 							draw_screen()
@@ -565,7 +1890,40 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 					}
 				}
 			}
-		} else if ev.MatchesPressOrRepeat("esc") {
+		} else if bound("focus") {
+			ev.Handled = true
+			focus = utils.IfElse(focus == "navigate", "type", "navigate")
+			reset()
+			draw_screen()
+		} else if bound("peek") {
+			ev.Handled = true
+			peek = !peek
+			draw_screen()
+		} else if o.Multiple && bound("select_all") {
+			ev.Handled = true
+			// select all remaining matches, in the order they are displayed
+			for _, idx := range ordered_indices {
+				if m := index_map[idx]; m != nil && !ignore_mark_indices.Has(idx) {
+					if _, ok := hint_for(m); ok {
+						chosen = append(chosen, m)
+						ignore_mark_indices.Add(idx)
+						chosen_indices.Add(idx)
+					}
+				}
+			}
+			lp.Quit(0)
+		} else if o.Multiple && bound("undo") {
+			ev.Handled = true
+			// undo the last selection, making the match selectable again
+			if len(chosen) > 0 {
+				m := chosen[len(chosen)-1]
+				chosen = chosen[:len(chosen)-1]
+				ignore_mark_indices.Discard(m.Index)
+				chosen_indices.Discard(m.Index)
+				reset()
+				draw_screen()
+			}
+		} else if bound("quit") {
 			if o.Multiple {
 				lp.Quit(0)
 			} else {
@@ -575,24 +1933,194 @@ func main(_ *cli.Command, o *Options, args []string) (rc int, err error) {
 		return nil
 	}
 
-	err = lp.Run()
-	if err != nil {
-		return 1, err
+	if o.LogKeys != "" {
+		log_file, err := os.OpenFile(utils.Expanduser(o.LogKeys), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return 1, fmt.Errorf("Failed to open the key log file %#v with error: %w", o.LogKeys, err)
+		}
+		defer log_file.Close()
+		// describe the action taken by an event by comparing state before and after it
+		type state struct {
+			input           string
+			position, count int
+		}
+		snapshot := func() state { return state{current_input, selected_position, len(chosen)} }
+		describe := func(before state, handled bool) string {
+			switch {
+			case len(chosen) > before.count:
+				m := chosen[len(chosen)-1]
+				if m.action() == MARK_ACTION_CLOSE {
+					return fmt.Sprintf("close %#v", m.Text)
+				}
+				return fmt.Sprintf("choose %#v", m.Text)
+			case lp.ExitCode() != 0:
+				return "quit"
+			case current_input != before.input:
+				return fmt.Sprintf("input %#v", current_input)
+			case selected_position != before.position:
+				return fmt.Sprintf("select %d", selected_position)
+			case handled:
+				return "handled"
+			}
+			return "none"
+		}
+		log_event := func(kind, event string, before state, handled bool) {
+			_, _ = log_file.WriteString(format_event_log(time.Now(), kind, event, describe(before, handled)))
+		}
+		on_key_event, on_mouse_event, on_text, on_rc_response := lp.OnKeyEvent, lp.OnMouseEvent, lp.OnText, lp.OnRCResponse
+		lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+			before := snapshot()
+			err := on_key_event(ev)
+			log_event("key", ev.String(), before, ev.Handled)
+			return err
+		}
+		lp.OnMouseEvent = func(ev *loop.MouseEvent) error {
+			before := snapshot()
+			err := on_mouse_event(ev)
+			log_event("mouse", ev.String(), before, false)
+			return err
+		}
+		lp.OnText = func(text string, from_key_event, in_bracketed_paste bool) error {
+			before := snapshot()
+			err := on_text(text, from_key_event, in_bracketed_paste)
+			log_event("text", fmt.Sprintf("%#v", text), before, false)
+			return err
+		}
+		lp.OnRCResponse = func(data []byte) error {
+			before := snapshot()
+			err := on_rc_response(data)
+			log_event("click", string(data), before, false)
+			return err
+		}
+	}
+
+	if o.Timeout > 0 {
+		// quit without a selection when there is no input, see --timeout
+		var idle_timer loop.IdType
+		restart_idle_timer := func() {
+			if idle_timer != 0 {
+				lp.RemoveTimer(idle_timer)
+			}
+			idle_timer, _ = lp.AddTimer(time.Duration(o.Timeout*float64(time.Second)), false, func(loop.IdType) error {
+				idle_timer = 0
+				lp.Quit(1)
+				return nil
+			})
+		}
+		on_initialize, on_key_event, on_mouse_event, on_text := lp.OnInitialize, lp.OnKeyEvent, lp.OnMouseEvent, lp.OnText
+		lp.OnInitialize = func() (string, error) {
+			restart_idle_timer()
+			return on_initialize()
+		}
+		lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+			restart_idle_timer()
+			return on_key_event(ev)
+		}
+		lp.OnMouseEvent = func(ev *loop.MouseEvent) error {
+			restart_idle_timer()
+			return on_mouse_event(ev)
+		}
+		lp.OnText = func(text string, from_key_event, in_bracketed_paste bool) error {
+			restart_idle_timer()
+			return on_text(text, from_key_event, in_bracketed_paste)
+		}
+	}
+
+	// write every selection to --stream-fd as soon as it is made
+	stream_chosen := func() {}
+	if o.StreamFd > 0 {
+		stream := os.NewFile(uintptr(o.StreamFd), "stream")
+		if _, err := stream.Stat(); err != nil {
+			return 1, fmt.Errorf("Invalid --stream-fd %d with error: %w", o.StreamFd, err)
+		}
+		enc := json.NewEncoder(stream)
+		streamed := 0
+		stream_chosen = func() {
+			// selections that were undone have already been written
+			for streamed = min(streamed, len(chosen)); streamed < len(chosen); streamed++ {
+				m := chosen[streamed]
+				_ = enc.Encode(match_record{Match: output_for(m), Groupdict: m.Groupdict, Action: m.action()})
+			}
+		}
+		on_key_event, on_mouse_event, on_text, on_rc_response := lp.OnKeyEvent, lp.OnMouseEvent, lp.OnText, lp.OnRCResponse
+		lp.OnKeyEvent = func(ev *loop.KeyEvent) error {
+			defer stream_chosen()
+			return on_key_event(ev)
+		}
+		lp.OnMouseEvent = func(ev *loop.MouseEvent) error {
+			defer stream_chosen()
+			return on_mouse_event(ev)
+		}
+		lp.OnText = func(text string, from_key_event, in_bracketed_paste bool) error {
+			defer stream_chosen()
+			return on_text(text, from_key_event, in_bracketed_paste)
+		}
+		lp.OnRCResponse = func(data []byte) error {
+			defer stream_chosen()
+			return on_rc_response(data)
+		}
+	}
+
+	if o.AutoSelectUnique && !o.Multiple && len(index_map) == 1 {
+		// nothing to choose, so dont show the overlay at all
+		for _, m := range index_map {
+			chosen = append(chosen, m)
+		}
+		// the loop never runs, so copy directly, as OnFinalize would have
+		if o.CopyToClipboard {
+			if text := clipboard_text(chosen, o, output_for); text != "" {
+				if term, err := tty.OpenControllingTerm(); err == nil {
+					err = term.WriteAllString(copy_escape_code(text, o.ClipboardTarget))
+					term.Close()
+					result.Copied_to_clipboard = err == nil
+				}
+			}
+		}
+	} else {
+		err = lp.Run()
+		if err != nil {
+			return 1, err
+		}
+		ds := lp.DeathSignalName()
+		if ds != "" {
+			fmt.Println("Killed by signal: ", ds)
+			lp.KillIfSignalled()
+			return 1, nil
+		}
+		if lp.ExitCode() != 0 {
+			return lp.ExitCode(), nil
+		}
 	}
-	ds := lp.DeathSignalName()
-	if ds != "" {
-		fmt.Println("Killed by signal: ", ds)
-		lp.KillIfSignalled()
-		return 1, nil
+	// selections made other than by input, such as after --prefix-conflict
+	// timeouts
+	stream_chosen()
+	if o.EnableHistory {
+		recent := history_cache.Opts.Recent
+		if recent == nil {
+			recent = make(map[string][]string)
+		}
+		for _, m := range chosen {
+			if m.action() == MARK_ACTION_SELECT {
+				recent[o.Type] = add_to_history(recent[o.Type], m.Text)
+			}
+		}
+		history_cache.Opts.Recent = recent
+		history_cache.Save()
 	}
-	if lp.ExitCode() != 0 {
-		return lp.ExitCode(), nil
+	// sorting happens only once all selection is complete
+	chosen = sort_chosen(chosen, o.SortOutput)
+	add_chosen_to_result(&result, chosen, text, output_for, o.GroupOutputByLine)
+	if o.OutputFile != "" {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return 1, err
+		}
+		if err = write_output_file(o.OutputFile, append(data, '\n')); err != nil {
+			return 1, fmt.Errorf("Failed to write output to %#v with error: %w", o.OutputFile, err)
+		}
 	}
-	result.Match = make([]string, len(chosen))
-	result.Groupdicts = make([]map[string]any, len(chosen))
-	for i, m := range chosen {
-		result.Match[i] = m.Text + match_suffix
-		result.Groupdicts[i] = m.Groupdict
+	if o.OutputFormat == "jsonl" {
+		return 0, write_jsonl(os.Stdout, &result)
 	}
 	fmt.Println(output(result))
 	return
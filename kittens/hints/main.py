@@ -105,12 +105,86 @@ def custom_marking() -> None:
 
 --type
 default=url
-choices=url,regex,path,line,hash,word,linenum,hyperlink,ip
+choices=url,regex,path,line,hash,word,linenum,hyperlink,ip,git-ref,escaped,log-entry,keyvalue,email,markdown,uuid,fileloc,semver,quoted,phone,socket,color,call,kv,base64,issue,image,import,traceback,number,k8s
 The type of text to search for. A value of :code:`linenum` is special, it looks
 for error messages using the pattern specified with :option:`--regex`, which
 must have the named groups: :code:`path` and :code:`line`. If not specified,
 will look for :code:`path:line`. The :option:`--linenum-action` option
 controls where to display the selected error message, other options are ignored.
+A value of :code:`line` selects every non-blank line, with soft wrapped lines
+treated as a single line and leading and trailing blanks removed.
+A value of :code:`git-ref` looks for git references such as :code:`origin/main`,
+:code:`refs/heads/feature`, :code:`HEAD~3` and tags like :code:`v1.2.3`. The
+:code:`remote`, :code:`ref` and relative :code:`suffix` (such as :code:`~3`)
+parts are available as named groups. A value of :code:`escaped` looks for text
+containing escape sequences, see :option:`--escape-families`, and outputs the
+decoded text, unless :option:`--no-decode` is specified. A value of
+:code:`log-entry` selects entire multi-line log entries, made up of a line
+followed by any continuation lines, see :option:`--continuation-pattern`. A
+value of :code:`keyvalue` selects :code:`key=value` and :code:`key: value`
+pairs, such as in config dumps, environment variables or query strings, see
+:option:`--keyvalue-part`, :code:`kv` is a shorter name for it. A value of
+:code:`email` selects email addresses, with the :code:`user` and :code:`domain`
+named groups. A value of :code:`ip` selects IPv4 and IPv6 addresses, with an
+optional CIDR prefix length, with the :code:`family` (:code:`v4` or
+:code:`v6`) and :code:`prefix` named groups.
+A value of :code:`markdown` selects the URLs of Markdown links of the form
+:code:`[label](url)` and :code:`<url>`, with the hint drawn over the label,
+which is available as the :code:`label` named group. A value of :code:`uuid`
+selects UUIDs such as :code:`{{{{123e4567-e89b-12d3-a456-426614174000}}}}`, without
+any surrounding braces, with the :code:`version` named group. A value of
+:code:`fileloc` is like :code:`linenum`, but looks for locations of the form
+:code:`path:line:column`, such as in compiler output, with the column being
+optional. The selected text is the path and the :code:`path`, :code:`line`
+and :code:`column` named groups are available. A value of :code:`semver`
+selects semantic version strings such as :code:`v1.2.3-rc.1+build`, with the
+:code:`major`, :code:`minor`, :code:`patch`, :code:`prerelease` and
+:code:`build` named groups. A value of :code:`quoted` selects the contents of
+single, double and backtick quoted strings, with the :code:`quote` named group
+being the quote character. A value of :code:`phone` selects phone numbers, made
+up of groups of digits, with an optional country code and area code, such as
+:code:`+1 (555) 123-4567`. For numbers with a country code, the compact
+:code:`+15551234567` form is available as the :code:`e164` named group. A
+value of :code:`socket` selects network addresses of the form
+:code:`host:port`, where host is an IPv4 address, an IPv6 address in brackets,
+:code:`localhost` or a hostname with at least one dot, with the :code:`host`
+and :code:`port` named groups. A value of :code:`color` selects CSS colors
+of the form :code:`#RGB`, :code:`#RRGGBB`, :code:`#RRGGBBAA`, :code:`rgb()`,
+:code:`rgba()`, :code:`hsl()` and :code:`hsla()`, with the color normalized to
+hex in the :code:`hex` named group. Hints are drawn using the matched color as
+their background, as a preview. A value of :code:`call` selects the names of
+functions in calls, that is identifiers immediately followed by an opening
+parenthesis, such as :code:`Bar` in :code:`foo.Bar(` or :code:`method` in
+:code:`pkg::method(`, with any receiver or namespace in the :code:`receiver`
+named group. A value of :code:`base64` selects base64 encoded data, see
+:option:`--base64-min-length`, with the decoded data in the :code:`decoded`
+named group, if it is text. A value of :code:`issue` selects issue references
+such as :code:`ABC-123`, :code:`#4567` and :code:`org/repo#12`, with the
+:code:`project`, :code:`repo` and :code:`number` named groups, see
+:option:`--issue-url`. A value of :code:`image` selects container image
+references that have a tag, a digest or both, such as
+:code:`registry:5000/org/repo:tag@sha256:...`, with the :code:`registry`,
+:code:`repository`, :code:`tag` and :code:`digest` named groups. A value of
+:code:`import` selects the module specifiers of imports in source code, such as
+:code:`./util` in :code:`import {{{{x}}}} from './util'`, see
+:option:`--import-languages`, with the :code:`specifier`, :code:`language` and
+:code:`kind` named groups, the kind being the syntax, such as
+:code:`require`. A value of :code:`traceback` is like :code:`fileloc`, but
+looks for the frames of Go, Python and Node.js stack traces, with the
+:code:`file`, :code:`line` and, when present, :code:`function` and
+:code:`column` named groups. The selected text is :code:`file:line`.
+A value of :code:`number` selects numbers and currency amounts such as
+:code:`$1,234.56`, :code:`99€` and :code:`1_000`, see
+:option:`--number-currency` and :option:`--number-separators`, with the
+number, without separators, in the :code:`value` named group and any currency
+symbol in the :code:`currency` named group. Numbers in versions, IP addresses
+and dates are not selected. A value of :code:`k8s` selects Kubernetes resources
+of the form :code:`kind/name`, such as :code:`deployment/web` or
+:code:`deployment.apps/web`, and :code:`namespace/name`, such as
+:code:`default/web-7c5d-abcde`, as in the output of :program:`kubectl`, with
+the :code:`kind`, :code:`group`, :code:`namespace` and :code:`name` named
+groups. To not select parts of paths, the names of the :code:`namespace/name`
+form cannot contain dots.
 
 
 --regex
@@ -128,6 +202,111 @@ def custom_marking() -> None:
 to each named group of the form :code:`key=value`.
 
 
+--group
+The name of a named group in :option:`--regex` to use as the matched text,
+instead of the whole match. For the :code:`keyvalue` and :code:`kv` types, one
+of :code:`key`, :code:`value` or :code:`pair`, see :option:`--keyvalue-part`.
+The other named groups are still available to :option:`--program` and
+:option:`--customize-processing`.
+
+
+--unwrap-before-match
+type=bool-set
+Join lines that were wrapped because they are wider than the window before
+looking for matches, so that patterns can match text, such as long URLs, that
+is split over multiple screen lines. Does not apply to the :code:`word`,
+:code:`hyperlink` and :code:`log-entry` types, or to
+:option:`--customize-processing`.
+
+
+--extract
+default=none
+choices=none,host
+Post-process the matched text regardless of :option:`--type`. A value of
+:code:`host` replaces the matched text with just its host component, for URLs,
+email addresses, ssh targets and IP addresses. Matches without a host component
+are left unchanged.
+
+
+--line-filter
+Only look for matches on lines that match this regular expression, in the
+same syntax as :option:`--regex`. Other lines are still displayed but no hints
+are created on them. For example, use :code:`--line-filter=ERROR` to only hint
+URLs in lines containing ERROR. Works with any :option:`--type`.
+
+
+--region-left
+default=0
+type=int
+Only create hints for matches that are entirely in or to the right of this
+column of the screen, counting from one, useful to ignore panes such as a
+sidebar in programs that split the screen. Zero means no limit.
+
+
+--region-right
+default=0
+type=int
+Only create hints for matches that are entirely in or to the left of this
+column of the screen, counting from one. Soft wrapped matches extend to the
+end of the rows they are wrapped at, so they are not hinted unless this is at
+least the width of the screen. Zero means no limit.
+
+
+--prefer
+default=all
+choices=all,broadest,narrowest
+How to handle matches nested inside other matches, for example, a path inside
+a URL, as can happen with a :option:`--customize-processing` script or
+overlapping patterns. :code:`broadest` keeps only the outermost match,
+:code:`narrowest` keeps only the innermost match and :code:`all` keeps both.
+Matches that merely overlap without one containing the other are always kept.
+This is applied to all matches, regardless of which pattern or :option:`--type`
+produced them.
+
+
+--strip-chars
+default=default
+Characters to strip from the start and end of every match. A bracket is only
+stripped if it is not balanced by a matching bracket inside the match, so that
+URLs such as :code:`https://en.wikipedia.org/wiki/Foo_(bar)` are left intact.
+The special value :code:`default` strips only trailing :code:`.,?!)]}}}}>'"` and
+brackets around the whole match, for the :code:`url` and :code:`path` types,
+so paths such as :code:`./foo` are left intact, and nothing for the other
+types. Use an empty value to disable stripping.
+
+
+--context-chars
+type=int
+default=0
+Add up to the specified number of characters before and after every match, on
+the same line, as the :code:`prefix` and :code:`suffix` named groups. Useful
+for custom processors that need to know the context of a match. Zero, the
+default, disables this.
+
+
+--dedup
+type=bool-set
+Only hint the first occurrence of every distinct match, so that text repeated
+many times on the screen, such as the same URL, gets a single hint. The other
+occurrences are displayed but cannot be selected.
+
+
+--match-action
+default=default
+choices=default,scroll_to,open_url,kubectl_describe
+What to do with the selected matches. :code:`default` acts on them as specified
+by :option:`--program`. :code:`scroll_to` instead marks all occurrences of the
+selected text in the window, using the same mechanism as the
+:ac:`toggle_marker` action, and scrolls the window back to the previous
+occurrence. Use the :ac:`scroll_to_mark` action to move between occurrences
+and :ac:`remove_marker` to remove the marks. :code:`open_url` acts on the URL
+of the selected matches instead of their text, for matches that have a
+:code:`url` named group, such as issue references with :option:`--issue-url`.
+:code:`kubectl_describe` runs :code:`kubectl describe` for the selected
+resources, of the :code:`k8s` :option:`--type`, in overlay windows. Resources of
+the form :code:`namespace/name` are described as pods.
+
+
 --linenum-action
 default=self
 type=choice
@@ -141,8 +320,70 @@ def custom_marking() -> None:
 example:
 :code:`kitten hints --type=linenum --linenum-action=tab vim +{line} {path}`
 will open the matched path at the matched line number in vim in
-a new kitty tab. Note that in order to use :option:`--program` to copy or paste
-the provided arguments, you need to use the special value :code:`self`.
+a new kitty tab. With :code:`--type=fileloc` the matched column is available
+as :code:`{column}`, the same is true for :code:`--type=traceback`, for stack
+traces that include it. Note that in order to use :option:`--program` to copy
+or paste the provided arguments, you need to use the special value
+:code:`self`.
+
+
+--escape-families
+default=percent,backslash,html
+Comma separated list of the kinds of escape sequences to recognize when
+:option:`--type` is :code:`escaped`. :code:`percent` is URL percent encoding
+such as :code:`%20`, :code:`backslash` is escapes such as ``\n`` and
+``\x41`` and :code:`html` is HTML entities such as :code:`&amp;`.
+Sequences are decoded in the order specified.
+
+
+--no-decode
+type=bool-set
+When :option:`--type` is :code:`escaped`, output the matched text as is,
+instead of decoding the escape sequences in it.
+
+
+--import-languages
+default=js,css,python,go,rust
+Comma separated list of the languages whose import syntaxes are recognized when
+:option:`--type` is :code:`import`. :code:`js` is :code:`import ... from`,
+:code:`export ... from`, :code:`import()` and :code:`require()`, :code:`css`
+is :code:`@import`, :code:`python` is :code:`import` and :code:`from ...
+import`, :code:`go` is :code:`import`, including import blocks, and
+:code:`rust` is :code:`use`.
+
+
+--continuation-pattern
+default=^\s
+A regular expression, in the same syntax as :option:`--regex`, that matches
+lines that continue the previous log entry when :option:`--type` is
+:code:`log-entry`. The default matches lines starting with whitespace.
+
+
+--keyvalue-part
+default=value
+choices=value,key,pair
+What to select when :option:`--type` is :code:`keyvalue`: the value, with
+any surrounding quotes removed, the key or the whole pair. The key and value are
+always available as the :code:`key` and :code:`value` named groups. Unquoted
+values end at whitespace or :code:`&`. Can also be specified using
+:option:`--group`, which takes precedence.
+
+
+--number-currency
+default=optional
+choices=optional,required,none
+How currency symbols, such as :code:`$` and :code:`€`, before or after numbers
+are handled when :option:`--type` is :code:`number`. :code:`optional` selects
+numbers with or without them, including the symbol, :code:`required` selects
+only amounts with a symbol and :code:`none` selects only the number, without
+the symbol.
+
+
+--number-separators
+default=,_
+The characters that can separate groups of thousands in numbers when
+:option:`--type` is :code:`number`. Leave empty to only select numbers
+without separators.
 
 
 --url-prefixes
@@ -162,6 +403,37 @@ def custom_marking() -> None:
 Characters to consider as part of a word. In addition, all characters marked as
 alphanumeric in the Unicode database will be considered as word characters.
 Defaults to the :opt:`select_by_word_characters` option from :file:`kitty.conf`.
+For example, use :code:`_` to select identifiers in code and :code:`_-.` to
+also select names such as :code:`foo-bar` and :code:`dotted.name`.
+
+
+--issue-url
+type=list
+A template for the URL of issue references when :option:`--type` is
+:code:`issue`, for example, :code:`https://github.com/{{{{repo}}}}/issues/{{{{number}}}}`.
+Fields of the form :code:`{{{{name}}}}` are replaced by the named groups of the
+match. Can be specified multiple times, the first template for which the match
+has all fields is used. The URL is available as the :code:`url` named group,
+use :code:`--match-action=open_url` to open it.
+
+
+--base64-min-length
+default=20
+type=int
+The minimum number of characters in base64 encoded data when :option:`--type`
+is :code:`base64`. Shorter runs of base64 characters are usually words or
+identifiers rather than encoded data. Only runs containing both upper and lower
+case letters are matched, for the same reason.
+
+
+--hash-min-length
+default=7
+type=int
+The minimum number of hexadecimal digits in a hash when :option:`--type` is
+:code:`hash`. Hashes have at most forty digits, longer runs of hexadecimal
+digits, such as SHA-256 checksums, are not matched. Hashes are available in
+full as the :code:`hash` named group and abbreviated to twelve characters as the
+:code:`short` named group.
 
 
 --minimum-match-length
@@ -170,10 +442,44 @@ def custom_marking() -> None:
 The minimum number of characters to consider a match.
 
 
+--max-marks
+default=0
+type=int
+The maximum number of matches to show hints for, the first matches by position
+are kept and the rest cannot be selected. The number of matches not shown is
+displayed at the top right of the screen. Zero means no limit.
+
+
 --multiple
 type=bool-set
 Select multiple matches and perform the action on all of them together at the
-end. In this mode, press :kbd:`Esc` to finish selecting.
+end. In this mode, press :kbd:`Esc` to finish selecting. Press :kbd:`Ctrl+A`
+to select all remaining matches, excluding any hidden by the filter, see
+:option:`--filter-mode`, and finish. Press :kbd:`Ctrl+Z` to undo the last
+selection.
+
+
+--sticky-selection
+type=bool-set
+When used with :option:`--multiple`, keep already selected matches visible,
+displayed in reverse video, instead of hiding them. Selected matches are
+displayed regardless of what has been typed to narrow down the hints, typing
+only affects which of the remaining matches are offered.
+
+
+--auto-select-unique
+type=bool-set
+When there is only a single match, select it immediately without displaying
+the hints. Has no effect with :option:`--multiple`.
+
+
+--background
+type=bool-set
+Open the selected matches without taking focus away from the current window.
+Applies to programs that use :code:`launch`, for example,
+:code:`--program "launch --type=tab vim"`. The setting is also available to
+:option:`--customize-processing` scripts as the :code:`background` key of
+the result.
 
 
 --multiple-joiner
@@ -184,7 +490,24 @@ def custom_marking() -> None:
 :code:`json` - a JSON serialized list, :code:`auto` - an automatic choice, based
 on the type of text being selected. In addition, integers are interpreted as
 zero-based indices into the list of selections. You can use :code:`0` for the
-first selection and :code:`-1` for the last.
+first selection and :code:`-1` for the last. Any other value is used as is to
+join the selections, with the escapes :code:`\n` (newline), :code:`\t`
+(tab), :code:`\r` (carriage return), :code:`\0` (NUL) and :code:`\\`
+(backslash) replaced by the characters they represent, useful for piping the
+selections to other programs.
+
+
+--copy-to-clipboard
+type=bool-set
+Copy the selected text directly to the clipboard using the OSC 52 escape code
+instead of running any :option:`--program`. Multiple selections are joined as
+specified by :option:`--multiple-joiner`.
+
+
+--clipboard-target
+default=clipboard
+choices=clipboard,primary
+The selection to copy to when :option:`--copy-to-clipboard` is used.
 
 
 --add-trailing-space
@@ -194,6 +517,34 @@ def custom_marking() -> None:
 space when used together with :option:`--multiple`.
 
 
+--shell-quote
+type=bool-set
+Quote the selected text for use in a shell, using single quotes, when it
+contains spaces or other characters special to the shell. Useful when the
+match is going to be pasted into a shell. Any trailing space added by
+:option:`--add-trailing-space` is added after the quoted text.
+
+
+--sort-output
+default=none
+choices=none,position,text
+The order of the selected matches in the output when using
+:option:`--multiple`. The default, :code:`none`, keeps the order in which they
+were selected, :code:`position` sorts them by their position in the text and
+:code:`text` sorts them alphabetically. Sorting happens after all selection is
+complete.
+
+
+--group-output-by-line
+type=bool-set
+In addition to the list of matches, output a mapping of the line numbers
+(starting from one) of the input text to the list of matches selected on that
+line. Useful for reconstructing structured records from tabular text
+with :option:`--multiple`. The mapping is available as
+:code:`matches_by_line` in the data passed to :code:`handle_result()` when
+using :option:`--customize-processing`.
+
+
 --hints-offset
 default=1
 type=int
@@ -206,13 +557,150 @@ def custom_marking() -> None:
 lowercase English alphabets. Specify your preference as a string of characters.
 Note that you need to specify the :option:`--hints-offset` as zero to use the
 first character to highlight the first match, otherwise it will start with the
-second character by default.
+second character by default. Any characters can be used, including wide
+characters such as emoji, but each character must occur only once.
+
+
+--filter-mode
+type=bool-set
+Start in filter mode, where typed text filters the matches instead of selecting
+hints. Only matches containing the typed text, ignoring case, keep their hints,
+which are renumbered to stay short. Filter mode can also be entered at any time
+by pressing :kbd:`/`, if it is not in :option:`--alphabet`. Press :kbd:`Enter`
+to stop filtering and type hints, choosing the match directly if only one
+remains. Press :kbd:`Esc` to clear the filter, pressing it again quits.
+
+
+--text-entry
+type=bool-set
+Select matches by typing the start of their text, instead of hints. The typed
+text is shown at the bottom of the screen and only matches starting with it
+keep their hints. As soon as a single match remains it is chosen. Case is
+ignored only with :option:`--case-insensitive`. Press :kbd:`Enter` to stop
+typing text and type hints instead, and :kbd:`Esc` to clear the typed text.
+
+
+--vim-keys
+type=bool-set
+Also use the :kbd:`j` and :kbd:`k` keys to move the selection down and up and
+:kbd:`g` and :kbd:`G` to move it to the first and last match. If these
+characters are in :option:`--alphabet`, they move the selection only when no
+hint characters have been typed yet, otherwise they are used to type hints.
+This means that hints starting with these characters cannot be typed, so you
+should remove them from the alphabet.
+
+
+--key-bindings
+type=list
+Change the keys used for an action, of the form :code:`action:keys`, where
+:code:`keys` is a space separated list of keys that replaces the default keys
+for the action, for example, :code:`--key-bindings="next:ctrl+n down"`. Leave
+the keys empty to disable an action. Can be specified multiple times for
+different actions. The actions and their default keys are: :code:`next`
+(:kbd:`Down`, :kbd:`Tab`), :code:`prev` (:kbd:`Up`, :kbd:`Shift+Tab`),
+:code:`page_down` (:kbd:`Page Down`), :code:`page_up` (:kbd:`Page Up`),
+:code:`first` (:kbd:`Home`), :code:`last` (:kbd:`End`), :code:`select`
+(:kbd:`Enter`, :kbd:`Space`), :code:`close` (:kbd:`Delete`), :code:`quit`
+(:kbd:`Esc`), :code:`focus` (:kbd:`Ctrl+Space`), :code:`peek` (:kbd:`Ctrl+P`),
+:code:`select_all` (:kbd:`Ctrl+A`) and :code:`undo` (:kbd:`Ctrl+Z`).
+
+
+--prefix-conflict
+default=wait
+choices=wait,timeout,immediate
+What to do when the typed characters form a complete hint that is also the
+start of longer hints, for example, when both :code:`a` and :code:`ab` are
+hints. :code:`wait` waits for more characters or :kbd:`Enter`,
+:code:`timeout` chooses the complete hint if no further characters are typed
+within half a second and :code:`immediate` chooses the complete hint at once,
+making the longer hints unreachable.
+
+
+--numeric-keypad-hints
+type=bool-set
+Use the digits on the numeric keypad to select hints independently of the
+number row and :option:`--alphabet`. Typing a keypad digit switches the
+displayed hints to numbers, typing any other text switches back to hints from
+:option:`--alphabet`.
+
+
+--case-insensitive
+type=bool-set
+Ignore case when typing hints, so that, for example, :kbd:`A` and :kbd:`a`
+select the same hint. Hints are displayed in lower case. Note that letters that
+differ only in case are then the same hint character, so an alphabet with both
+cases effectively has half as many characters, leading to longer hints.
+
+
+--auto-expand-alphabet
+type=bool-set
+When there are more matches than characters in the alphabet, add characters
+from :option:`--alphabet-expansion` to the alphabet, so that as many hints as
+possible are a single character.
+
+
+--alphabet-expansion
+default=0123456789,./;'[]-=
+The characters, in order of preference, used to expand the alphabet when
+:option:`--auto-expand-alphabet` is specified. Characters already present in
+the alphabet are skipped.
+
+
+--exclude-confusables
+type=bool-set
+Remove characters that are easily mistaken for each other in small fonts, such
+as :code:`l`, :code:`1` and :code:`I`, from the alphabet, see
+:option:`--confusable-characters`. This is done after any expansion with
+:option:`--auto-expand-alphabet`.
+
+
+--confusable-characters
+default=01ilIoO
+The characters removed from the alphabet by :option:`--exclude-confusables`.
 
 
 --ascending
 type=bool-set
 Make the hints increase from top to bottom, instead of decreasing from top to
-bottom.
+bottom. Only applies to the :code:`position` :option:`--hint-order`.
+
+
+--min-hint-length
+default=0
+type=int
+The minimum number of characters in a hint. Shorter hints are padded with the
+first character of the alphabet, so that, for example, with
+:code:`--min-hint-length=2` and the default alphabet of 36 characters, all
+hints for up to 1296 matches are two characters long. Useful to avoid having
+to check whether a hint is complete before typing the next character.
+
+
+--hint-order
+default=position
+choices=position,reverse,cursor
+How to assign hints to matches, the shortest hints going to the preferred
+matches. :code:`position` orders matches by their position in the text, in the
+direction set by :option:`--ascending`, :code:`reverse` always prefers the last
+matches, nearest the bottom of the screen, and :code:`cursor` prefers the
+matches closest to the line the cursor is on, in the window being hinted.
+
+
+--hint-position
+default=start
+choices=start,end
+Where to draw the hint over each match. Use :code:`end` to keep the start of
+long matches, such as the directories in a path, visible and hide the end
+instead, or :code:`start` to keep the end, such as a file name, visible.
+
+
+--typing-emphasis
+default=dim-others
+choices=dim-others,highlight-matches
+How to distinguish the hints that match the characters typed so far. The
+default, :code:`dim-others`, dims the text of hints that do not match.
+:code:`highlight-matches` instead leaves non-matching text at normal intensity
+and emphasizes the text of matching hints, which can be more legible on bright
+color schemes.
 
 
 --hints-foreground-color
@@ -231,6 +719,14 @@ def custom_marking() -> None:
 color.
 
 
+--faint-style
+default=dim
+The style for the text of matches that do not match the typed hint characters.
+Either a style specification such as :code:`fg=#666666` or :code:`auto`
+for a color half way between the foreground and background colors of the
+window, which is more readable than :code:`dim` in some terminals.
+
+
 --hints-text-color
 default=auto
 type=str
@@ -239,6 +735,39 @@ def custom_marking() -> None:
 color. The default is to pick a suitable color automatically.
 
 
+--min-contrast
+type=float
+default=0
+The minimum contrast ratio, between 1 and 21, of the automatically picked
+:option:`--hints-text-color` with the window background. If neither of the
+colors normally picked from the color theme has at least this contrast, pure
+black or white is used instead. A value of :code:`4.5` ensures legible text on
+unusual themes.
+
+
+--type-colors
+type=list
+Colors for the hints when hinting the specified :option:`--type`, overriding
+:option:`--hints-foreground-color` and :option:`--hints-background-color`, of
+the form :code:`type:style`, for example, :code:`--type-colors="url:fg=black
+bg=cyan"`. Can be specified multiple times for different types.
+
+
+--selected-foreground-color
+type=str
+The foreground color for the item selected with the keyboard. The default is to
+use the foreground color of the hinted text. A value of :code:`auto` picks a
+color that contrasts with :option:`--selected-background-color`.
+
+
+--selected-background-color
+default=#444444
+type=str
+The background color for the item selected with the keyboard. A value of
+:code:`auto` picks a gray suitable for the window background, which is useful
+with light color themes.
+
+
 --customize-processing
 Name of a python file in the kitty config directory which will be imported to
 provide custom implementations for pattern finding and performing actions
@@ -246,12 +775,147 @@ def custom_marking() -> None:
 elsewhere. See {hints_url} for details.
 
 
+--keep-trailing-newlines
+type=bool-set
+Do not remove blank lines at the end of the text when displaying it. This
+keeps the rows displayed by the kitten in correspondence with the lines of the
+input text.
+
+
+--redraw-debounce
+default=0
+type=int
+Time in milliseconds to wait before redrawing the screen after moving the
+selection with the keyboard. Navigation keys pressed within this time are
+batched into a single redraw, reducing flicker and CPU usage when holding down
+a navigation key on large inputs. The default of zero redraws immediately.
+
+
+--flash-new
+type=bool-set
+Briefly flash marks that are newly revealed, for example, when deleting typed
+hint characters brings back marks that had been faded out. Only the display is
+affected, not what is selected.
+
+
+--show-count
+type=bool-set
+Show the number of matches remaining to be selected and the total number of
+matches at the top right corner of the window. Useful with
+:option:`--multiple`.
+
+
+--tab-width
+default=8
+type=int
+The number of cells between tab stops, used to expand tab characters in the
+text so that hints are drawn at the correct position. Zero disables expansion.
+
+
+--strip-ansi
+type=bool-set
+Remove all escape codes from the text before matching, other than OSC 8
+hyperlinks. Useful when the output of a program with colors and other
+formatting is piped in directly. Without this, only SGR formatting and OSC
+codes are removed.
+
+
+--output-format
+default=json
+choices=json,jsonl
+The format of the output when the kitten is run outside of kitty, with its
+result printed to STDOUT. :code:`json` prints a single JSON object with the list
+of selected matches and other information. :code:`jsonl` prints one JSON object
+per line for every selected match, with the :code:`match` and
+:code:`groupdict` keys, which is easier to process incrementally when
+selecting many matches with :option:`--multiple`. Using :code:`jsonl` when
+running inside kitty is an error, use :option:`--output-file` or
+:option:`--stream-fd` instead.
+
+
+--input-file
+Read the text to be hinted from the specified file instead of STDIN. Useful
+for scripting and testing, when STDIN is a terminal.
+
+
+--output-file
+Also write the selected matches, serialized as JSON, to the specified file. If
+the file is a FIFO it is written to directly, otherwise it is replaced
+atomically. Useful for integrations that watch a file for the result.
+
+
+--stream-fd
+default=0
+type=int
+Write every selected match to this already open file descriptor as soon as it
+is selected, as a JSON object on its own line with the :code:`match`,
+:code:`groupdict` and :code:`action` keys, in addition to the normal output.
+Useful with :option:`--multiple` to act on matches while more are being
+selected. Note that matches are written again if their selection is undone
+and they are selected again. Zero, the default, means no streaming.
+
+
+--hyperlink-prefix
+default=mark:
+The prefix of the URLs of the hyperlinks around matches in the overlay, which
+are of the form :code:`<prefix><index>`. Useful for integrations that handle
+clicks on matches themselves.
+
+
+--badge
+A template for a short badge displayed before every match, for example:
+:code:`--badge="[{{{{type}}}}] "`. Fields of the form :code:`{{{{name}}}}` are replaced by
+the value of the named group :code:`name` of the match, :code:`{{{{type}}}}` is
+replaced by the :option:`--type`. The badge is only displayed, it is not part
+of the selected text.
+
+
+--enable-history
+type=bool-set
+Remember the most recently selected text for every :option:`--type`. Press
+:kbd:`Ctrl+R` to cycle through the remembered text, most recent first, and
+:kbd:`Enter` to select it, even if it is not present in the current text. Such
+selections have the :code:`from_history` named group set and no position in
+the text, so their offsets and positions in the output are null.
+
+
+--timeout
+type=float
+default=0
+Quit without selecting anything if there is no keyboard or mouse input for the
+specified number of seconds. Useful to avoid the overlay lingering in scripted
+usage or detached sessions. Zero, the default, means no timeout.
+
+
+--hover-highlight
+type=bool-set
+Select the match under the mouse pointer as it moves, highlighting it the same
+way as a match selected with the keyboard.
+
+
+--numeric-overlay
+type=bool-set
+Display the one based ordinal of every match, in the order used for keyboard
+navigation, before its hint. Type the number of a match and press
+:kbd:`Enter` to select it. Digits are always used for the number, so this is
+most useful with alphabets that do not contain digits.
+
+
+--log-keys
+Append every keyboard, mouse and text event processed by the kitten, along
+with a timestamp and the resulting action, to the specified file. Useful for
+diagnosing problems with keybindings. Nothing is written to STDOUT or STDERR.
+
+
 --window-title
 The title for the hints window, default title is based on the type of text being
-hinted.
+hinted. The title can contain the fields :code:`{{{{type}}}}`, the
+:option:`--type`, :code:`{{{{count}}}}`, the number of matches and
+:code:`{{{{remaining}}}}`, the number of matches not yet selected, which is
+updated after every selection with :option:`--multiple`.
 '''.format(
     default_regex=DEFAULT_REGEX,
-    line='{{line}}', path='{{path}}',
+    line='{{line}}', path='{{path}}', column='{{column}}',
     hints_url=website_url('kittens/hints'),
 ).format
 help_text = 'Select text from the screen using the keyboard. Defaults to searching for URLs.'
@@ -262,21 +926,21 @@ def main(args: list[str]) -> dict[str, Any] | None:
     raise SystemExit('Should be run as kitten hints')
 
 
-def linenum_process_result(data: dict[str, Any]) -> tuple[str, int]:
+def linenum_process_result(data: dict[str, Any]) -> tuple[str, int, int]:
     for match, g in zip(data['match'], data['groupdicts']):
         path, line = g['path'], g['line']
         if path and line:
-            return path, int(line)
-    return '', -1
+            return path, int(line), int(g.get('column') or 0)
+    return '', -1, 0
 
 
 def linenum_handle_result(args: list[str], data: dict[str, Any], target_window_id: int, boss: BossType, extra_cli_args: Sequence[str], *a: Any) -> None:
-    path, line = linenum_process_result(data)
+    path, line, column = linenum_process_result(data)
     if not path:
         return
 
     if extra_cli_args:
-        cmd = [x.format(path=path, line=line) for x in extra_cli_args]
+        cmd = [x.format(path=path, line=line, column=column) for x in extra_cli_args]
     else:
         cmd = get_editor(path_to_edit=path, line_number=line)
     w = boss.window_id_map.get(target_window_id)
@@ -318,29 +982,71 @@ def is_copy_action(s: str) -> bool:
             }[action])(*cmd)
 
 
-def on_mark_clicked(boss: BossType, window: WindowType, url: str, hyperlink_id: int, cwd: str) -> bool:
-    if url.startswith('mark:'):
-        window.send_cmd_response({'Type': 'mark_activated', 'Mark': int(url[5:])})
-        return True
-    return False
+@lru_cache(maxsize=4)
+def hyperlink_prefix_for(args: tuple[str, ...]) -> str:
+    try:
+        opts = parse_hints_args(list(args[1:]))[0]
+    except SystemExit:
+        return 'mark:'
+    return opts.hyperlink_prefix
+
+
+def on_mark_clicked(args: Sequence[str], boss: BossType, window: WindowType, url: str, hyperlink_id: int, cwd: str) -> bool:
+    # only the hyperlinks around marks are handled here, any other URLs are
+    # opened normally
+    prefix = hyperlink_prefix_for(tuple(args))
+    idx = url[len(prefix):] if url.startswith(prefix) else ''
+    if not idx.isdigit():
+        return False
+    window.send_cmd_response({'Type': 'mark_activated', 'Mark': int(idx)})
+    return True
 
 
 @result_handler(type_of_input='screen-ansi', has_ready_notification=True, open_url_handler=on_mark_clicked)
 def handle_result(args: list[str], data: dict[str, Any], target_window_id: int, boss: BossType) -> None:
     cp = data['customize_processing']
-    if data['type'] == 'linenum':
+    if data['type'] in ('linenum', 'fileloc', 'traceback'):
         cp = '::linenum::'
     if cp:
         m = load_custom_processor(cp)
         if 'handle_result' in m:
             m['handle_result'](args, data, target_window_id, boss, data['extra_cli_args'])
             return None
+    if data.get('copied_to_clipboard'):
+        return None
+    if data.get('match_action') == 'kubectl_describe':
+        w = boss.window_id_map.get(target_window_id)
+        actions = data.get('actions') or ['select'] * len(data['groupdicts'])
+        for g, action in zip(data['groupdicts'], actions):
+            if not g or not g.get('name') or action != 'select':
+                continue
+            kind = g.get('kind') or 'pod'
+            if g.get('group'):
+                kind += '.' + g['group']
+            cmd = ['kubectl', 'describe', kind, g['name']]
+            if g.get('namespace'):
+                cmd += ['--namespace', g['namespace']]
+            boss.call_remote_control(self_window=w, args=('launch', '--type=overlay', '--hold', '--cwd=' + data['cwd'], *cmd))
+        return None
+    if data.get('match_action') == 'scroll_to':
+        w = boss.window_id_map.get(target_window_id)
+        spec = ['text']
+        for m in data['match']:
+            if m:
+                spec += ['1', m]
+        if w is not None and len(spec) > 1:
+            # mark all occurrences of the matches and scroll back to the previous one
+            w.set_marker(spec)
+            w.scroll_to_mark(prev=True, mark=1)
+        return None
 
     programs = data['programs'] or ('default',)
     matches: list[str] = []
     groupdicts = []
-    for m, g in zip(data['match'], data['groupdicts']):
-        if m:
+    actions = data.get('actions') or ['select'] * len(data['match'])
+    for m, g, action in zip(data['match'], data['groupdicts'], actions):
+        # other actions such as close are handled by the caller
+        if m and action == 'select':
             matches.append(m)
             groupdicts.append(g)
     joiner = data['multiple_joiner']
@@ -363,7 +1069,7 @@ def joined_text() -> str:
         if joiner == 'auto':
             q = '\n\r' if text_type in ('line', 'url') else ' '
         else:
-            q = {'newline': '\n\r', 'space': ' '}.get(joiner, '')
+            q = {'newline': '\n\r', 'space': ' ', 'empty': ''}.get(joiner, joiner)
         return q.join(matches)
 
     for program in programs:
@@ -393,6 +1099,8 @@ def joined_text() -> str:
                 if isinstance(program, str) and program.startswith('launch '):
                     launch_args = to_cmdline(program)
                     launch_args.insert(1, '--cwd=' + cwd)
+                    if data.get('background'):
+                        launch_args.insert(1, '--keep-focus')
                 for m, groupdict in zip(matches, groupdicts):
                     if groupdict:
                         m = []
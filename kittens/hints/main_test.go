@@ -0,0 +1,747 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package hints
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kovidgoyal/kitty"
+	"github.com/kovidgoyal/kitty/tools/utils"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestHintEncoding(t *testing.T) {
+	if diff := cmp.Diff([]string{"a", "b", "c", "ba", "bb"}, Hints(5, "abc")); diff != "" {
+		t.Fatalf("Unexpected hints:\n%s", diff)
+	}
+	if h := Hints(0, "abc"); h != nil {
+		t.Fatalf("Unexpected hints for zero marks: %#v", h)
+	}
+	if h := Hints(3, "a"); h != nil {
+		t.Fatalf("Unexpected hints for single character alphabet: %#v", h)
+	}
+	if h := Hints(11, ""); h[10] != "a" {
+		t.Fatalf("Default alphabet not used for empty alphabet: %#v", h)
+	}
+	for _, alphabet := range []string{"", "abc", "asdfghjkl;", "αβγδ", "😀😁😂"} {
+		for i, h := range Hints(100, alphabet) {
+			if d, err := DecodeHint(h, alphabet); err != nil || d != i {
+				t.Fatalf("Decoding %#v with alphabet %#v gave %d instead of %d: %v", h, alphabet, d, i, err)
+			}
+			if e := EncodeHint(i, alphabet); e != h {
+				t.Fatalf("Encoding %d with alphabet %#v gave %#v instead of %#v", i, alphabet, e, h)
+			}
+		}
+	}
+	for _, x := range []struct{ hint, alphabet, bad string }{{"ax", "abc", "x"}, {"1", "αβγ", "1"}, {"", "abc", "empty"}} {
+		if _, err := DecodeHint(x.hint, x.alphabet); err == nil || !strings.Contains(err.Error(), x.bad) {
+			t.Fatalf("Decoding %#v with alphabet %#v did not fail correctly: %v", x.hint, x.alphabet, err)
+		}
+	}
+}
+
+func TestExpandAlphabet(t *testing.T) {
+	for _, x := range []struct {
+		alphabet, extra string
+		size            int
+		expected        string
+	}{
+		{"abc", "0123", 2, "abc"},
+		{"abc", "0123", 5, "abc01"},
+		{"abc", "a0b1", 5, "abc01"},
+		{"abc", "01", 10, "abc01"},
+		{"αβ", "γα😀", 4, "αβγ😀"},
+	} {
+		if actual := expand_alphabet(x.alphabet, x.extra, x.size); actual != x.expected {
+			t.Fatalf("Expanding %#v with %#v to %d gave %#v instead of %#v", x.alphabet, x.extra, x.size, actual, x.expected)
+		}
+	}
+}
+
+func TestValidateAlphabet(t *testing.T) {
+	for _, a := range []string{"ab", DEFAULT_HINT_ALPHABET, KEYPAD_HINT_ALPHABET} {
+		if err := validate_alphabet(a); err != nil {
+			t.Fatalf("Valid alphabet %#v rejected: %s", a, err)
+		}
+	}
+	for a, expected := range map[string]string{
+		"abca": `"a" more than once`,
+		"aA1A": `"A" more than once`,
+		"x":    "at least two",
+		"":     "at least two",
+	} {
+		err := validate_alphabet(a)
+		if err == nil {
+			t.Fatalf("Invalid alphabet %#v not rejected", a)
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Error for alphabet %#v does not contain %#v: %s", a, expected, err)
+		}
+	}
+}
+
+func TestEmojiAlphabet(t *testing.T) {
+	alphabet := "🍎🍌🍒🍇"
+	if err := validate_alphabet(alphabet); err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range Hints(20, alphabet) {
+		if actual, _ := DecodeHint(h, alphabet); actual != i {
+			t.Fatalf("Decoding emoji hint %#v failed: %d != %d", h, actual, i)
+		}
+	}
+	if err := validate_alphabet("🍎🍌🍎"); err == nil || !strings.Contains(err.Error(), "🍎") {
+		t.Fatalf("Unexpected error for duplicate emoji: %v", err)
+	}
+}
+
+func TestFoldAlphabet(t *testing.T) {
+	if actual := fold_alphabet("aAbBÉé1"); actual != "abé1" {
+		t.Fatalf("Unexpected folded alphabet: %#v", actual)
+	}
+}
+
+func TestExcludeCharacters(t *testing.T) {
+	if actual := exclude_characters(DEFAULT_HINT_ALPHABET, "01ilIoO"); actual != "23456789abcdefghjkmnpqrstuvwxyz" {
+		t.Fatalf("Unexpected alphabet: %#v", actual)
+	}
+	if actual := exclude_characters("αlβ", "l"); actual != "αβ" {
+		t.Fatalf("Unexpected alphabet: %#v", actual)
+	}
+}
+
+func TestBadgeTemplate(t *testing.T) {
+	m := &Mark{Groupdict: map[string]any{"index": 3, "state": "active"}}
+	if actual := expand_badge_template("[{type}:{state}:{index}{missing}] ", m, "url"); actual != "[url:active:3] " {
+		t.Fatalf("Unexpected badge: %#v", actual)
+	}
+}
+
+func TestTrailingNewlines(t *testing.T) {
+	opts := &Options{Type: "url", UrlPrefixes: "default", Regex: kitty.HintsDefaultRegex}
+	for _, trailer := range []string{"", "\n", "\n\n\n", "\r\n\r\n"} {
+		text := "one\nsee http://x.org/a\nend http://y.org" + trailer
+		ptext, marks, _, err := FindMarks(convert_text(text, 30), opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		if len(marks) != 2 {
+			t.Fatalf("%#v has unexpected marks: %v", text, marks)
+		}
+		for i, expected := range []string{"http://x.org/a", "http://y.org"} {
+			m := marks[i]
+			if actual := strings.ReplaceAll(ptext[m.Start:m.End], "\x00", ""); actual != expected {
+				t.Fatalf("%#v mark has incorrect offsets: %#v != %#v", text, actual, expected)
+			}
+			if ln := line_number_at(ptext, m.Start); ln != i+2 {
+				t.Fatalf("%#v mark has incorrect line number: %d != %d", text, ln, i+2)
+			}
+			if line, col := position_at(ptext, m.Start); line != i+2 || col != 5 {
+				t.Fatalf("%#v mark has incorrect position: (%d, %d) != (%d, 5)", text, line, col, i+2)
+			}
+		}
+	}
+}
+
+func TestAutoTextColor(t *testing.T) {
+	for _, x := range []struct {
+		bg, c8, c15  uint32
+		min_contrast float64
+		expected     string
+	}{
+		{0x000000, 0x666666, 0xffffff, 0, "bright-gray"},
+		{0xffffff, 0x666666, 0xeeeeee, 0, "bright-black"},
+		{0x777777, 0x707070, 0x808080, 0, "bright-gray"},
+		{0x777777, 0x707070, 0x808080, 4.5, "#000000"},
+		{0x202020, 0x1a1a1a, 0x262626, 4.5, "#ffffff"},
+		{0x000000, 0x666666, 0xffffff, 4.5, "bright-gray"},
+	} {
+		if actual := auto_text_color(x.bg, x.c8, x.c15, x.min_contrast); actual != x.expected {
+			t.Fatalf("Incorrect text color for background: %06x with minimum contrast %v: %#v != %#v", x.bg, x.min_contrast, actual, x.expected)
+		}
+	}
+}
+
+func TestTitleTemplate(t *testing.T) {
+	for template, expected := range map[string]string{
+		"Choose text":                   "Choose text",
+		"{type}: {remaining}/{count}":   "url: 3/5",
+		"{count} {count} {other} {type": "5 5 {other} {type",
+	} {
+		if actual := expand_title_template(template, "url", 5, 3); actual != expected {
+			t.Fatalf("Incorrect expansion of %#v: %#v != %#v", template, actual, expected)
+		}
+	}
+}
+
+func TestJSONLOutput(t *testing.T) {
+	result := Result{Match: []string{"a", "b<c"}, Groupdicts: []map[string]any{{"x": "1"}, nil}}
+	buf := strings.Builder{}
+	if err := write_jsonl(&buf, &result); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"match":"a","groupdict":{"x":"1"}}` + "\n" + `{"match":"b\u003cc","groupdict":null}` + "\n"
+	if diff := cmp.Diff(expected, buf.String()); diff != "" {
+		t.Fatalf("Incorrect JSONL output:\n%s", diff)
+	}
+}
+
+func TestHistoryResult(t *testing.T) {
+	text := "abc\nxy zzz"
+	chosen := []*Mark{{Index: 0, Start: 7, End: 10, Text: "zzz"}, history_mark("recalled")}
+	result := Result{}
+	add_chosen_to_result(&result, chosen, text, func(m *Mark) string { return m.Text }, true)
+	if diff := cmp.Diff([]string{"zzz", "recalled"}, result.Match); diff != "" {
+		t.Fatalf("Unexpected matches:\n%s", diff)
+	}
+	if diff := cmp.Diff([]*[2]int{{7, 10}, nil}, result.Offsets); diff != "" {
+		t.Fatalf("Unexpected offsets:\n%s", diff)
+	}
+	if diff := cmp.Diff([]*[2]int{{2, 4}, nil}, result.Positions); diff != "" {
+		t.Fatalf("Unexpected positions:\n%s", diff)
+	}
+	if diff := cmp.Diff(map[int][]string{2: {"zzz"}}, result.Matches_by_line); diff != "" {
+		t.Fatalf("Unexpected matches by line:\n%s", diff)
+	}
+	data, _ := json.Marshal(result.Offsets)
+	if string(data) != "[[7,10],null]" {
+		t.Fatalf("Unexpected JSON for offsets: %s", data)
+	}
+}
+
+func TestTrimTrailingBlanks(t *testing.T) {
+	// lines with double width characters are padded to the same number of cells
+	if actual := convert_text("日本\nab", 6); actual != "日本\x00\x00\nab\x00\x00\x00\x00" {
+		t.Fatalf("Incorrect padding of double width text: %#v", actual)
+	}
+	opts := &Options{Type: "regex", Regex: `x *`, MinimumMatchLength: 1}
+	text := convert_text("one x  \n\n", 10)
+	ptext, marks, _, err := FindMarks(text, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 || marks[0].Text != "x  " {
+		t.Fatalf("Unexpected marks: %v", marks)
+	}
+	if actual := trim_trailing_blanks(ptext, marks); actual != "one x  " {
+		t.Fatalf("Trimming removed part of a mark: %#v", actual)
+	}
+	if actual := trim_trailing_blanks(ptext, nil); actual != "one x" {
+		t.Fatalf("Incorrect trimming without marks: %#v", actual)
+	}
+}
+
+func TestHintCache(t *testing.T) {
+	hints := hint_cache{}
+	for _, alphabet := range []string{DEFAULT_HINT_ALPHABET, "ab", DEFAULT_HINT_ALPHABET} {
+		for i := range 100 {
+			if actual, expected := hints.hint(i, alphabet), encode_hint(i, alphabet, 0); actual != expected {
+				t.Fatalf("Cached hint for %d with alphabet %#v incorrect: %#v != %#v", i, alphabet, actual, expected)
+			}
+		}
+	}
+}
+
+func TestMinHintLength(t *testing.T) {
+	for _, x := range []struct {
+		num, min_length    int
+		alphabet, expected string
+	}{
+		{0, 2, "abc", "aa"},
+		{2, 2, "abc", "ac"},
+		{3, 2, "abc", "ba"},
+		{5, 0, "abc", "bc"},
+		{26, 2, "abc", "ccc"},
+		{27, 3, "abc", "baaa"},
+		{7, 3, DEFAULT_HINT_ALPHABET, "007"},
+	} {
+		hint := encode_hint(x.num, x.alphabet, x.min_length)
+		if hint != x.expected {
+			t.Fatalf("Incorrect hint for %d with minimum length %d: %#v != %#v", x.num, x.min_length, hint, x.expected)
+		}
+		if actual, _ := DecodeHint(hint, x.alphabet); actual != x.num {
+			t.Fatalf("Decoding padded hint %#v failed: %d != %d", hint, actual, x.num)
+		}
+	}
+	// no padded hint is a prefix of another, so typing a partial hint never
+	// selects a match
+	hints := hint_cache{min_length: 2}
+	all := map[string]bool{}
+	for i := range 9 {
+		all[hints.hint(i, "abc")] = true
+	}
+	for h := range all {
+		if all[h[:1]] {
+			t.Fatalf("Padded hint %#v has another hint as a prefix", h)
+		}
+	}
+}
+
+func TestVisibleRows(t *testing.T) {
+	rows := []string{"0", "1", "2", "3", "4"}
+	for _, x := range []struct {
+		height, scroll_back, top int
+		expected                 string
+	}{
+		{10, 0, 0, "01234"},
+		{5, 2, 0, "01234"},
+		{3, 0, 2, "234"},
+		{3, 1, 1, "123"},
+		{3, 7, 0, "012"},
+		{3, -1, 2, "234"},
+	} {
+		visible, top := visible_rows(rows, x.height, x.scroll_back)
+		if actual := strings.Join(visible, ""); actual != x.expected || top != x.top {
+			t.Fatalf("Incorrect rows for height: %d scroll_back: %d: %#v (top: %d) != %#v (top: %d)", x.height, x.scroll_back, actual, top, x.expected, x.top)
+		}
+	}
+}
+
+func TestKeypadDigit(t *testing.T) {
+	for key, expected := range map[string]string{"KP_0": "0", "KP_7": "7", "KP_ENTER": "", "7": "", "F1": ""} {
+		if actual, ok := keypad_digit(key); actual != expected || ok != (expected != "") {
+			t.Fatalf("Unexpected keypad digit for %#v: %#v", key, actual)
+		}
+	}
+}
+
+func TestJoinMatches(t *testing.T) {
+	matches := []string{"a", "b", "c"}
+	for _, x := range []struct{ joiner, text_type, expected string }{
+		{"auto", "url", "a\n\rb\n\rc"},
+		{"auto", "word", "a b c"},
+		{"empty", "url", "abc"},
+		{"space", "url", "a b c"},
+		{"0", "url", "a"},
+		{"-1", "url", "c"},
+		{"7", "url", "c"},
+		{"json", "url", "[\n\t\"a\",\n\t\"b\",\n\t\"c\"\n]"},
+		{unescape_joiner(`\n`), "word", "a\nb\nc"},
+		{unescape_joiner(`\0`), "word", "a\x00b\x00c"},
+		{unescape_joiner(`,\t`), "word", "a,\tb,\tc"},
+		{unescape_joiner(`\\n`), "word", "a\\nb\\nc"},
+	} {
+		if actual := join_matches(matches, x.joiner, x.text_type); actual != x.expected {
+			t.Fatalf("Unexpected result for joiner %#v: %#v != %#v", x.joiner, actual, x.expected)
+		}
+	}
+}
+
+func TestClipboardText(t *testing.T) {
+	o := &Options{CopyToClipboard: true, MultipleJoiner: "auto", Type: "url", SortOutput: "none"}
+	output_for := func(m *Mark) string { return m.Text }
+	// --auto-select-unique chooses the only mark without running the loop
+	index_map := map[int]*Mark{0: {Index: 0, Text: "https://a.org"}}
+	chosen := []*Mark{index_map[0]}
+	if actual := clipboard_text(chosen, o, output_for); actual != "https://a.org" {
+		t.Fatalf("Unexpected clipboard text for auto selected mark: %#v", actual)
+	}
+	chosen = append(chosen, &Mark{Index: 1, Text: "x", Action: MARK_ACTION_CLOSE})
+	if actual := clipboard_text(chosen, o, output_for); actual != "https://a.org" {
+		t.Fatalf("Unexpected clipboard text with a close action: %#v", actual)
+	}
+	if actual := clipboard_text(chosen[1:], o, output_for); actual != "" {
+		t.Fatalf("Unexpected clipboard text with nothing selected: %#v", actual)
+	}
+	if actual := copy_escape_code("abc", "clipboard"); actual != "\x1b]52;c;YWJj\x1b\\" {
+		t.Fatalf("Unexpected escape code: %#v", actual)
+	}
+	if actual := copy_escape_code("abc", "primary"); actual != "\x1b]52;p;YWJj\x1b\\" {
+		t.Fatalf("Unexpected escape code for primary: %#v", actual)
+	}
+}
+
+func TestOverlayHint(t *testing.T) {
+	for _, x := range []struct{ hint, text, drawn, rest string }{
+		{"ab", "file.txt", "ab", "le.txt"},
+		{"ab", "日本語/ファイル.txt", "ab", "本語/ファイル.txt"},
+		{"abc", "日本語/ファイル.txt", "abc ", "語/ファイル.txt"},
+		{"x", "http://😀.example.com", "x", "ttp://😀.example.com"},
+		{"x", "😀.example.com", "x ", ".example.com"},
+		{"ab", "a\rbc", "a\nb", "c"},
+		{"abc", "é", "abc", ""},
+		{"🍎🍌", "file.txt", "🍎🍌", ".txt"},
+		{"🍎", "a\rbc", "🍎\n", "bc"},
+		{"🍎", "a😀b", "🍎 ", "b"},
+	} {
+		drawn, rest := overlay_hint(x.hint, x.text)
+		if diff := cmp.Diff([]string{x.drawn, x.rest}, []string{drawn, rest}); diff != "" {
+			t.Fatalf("Incorrect overlay of %#v on %#v:\n%s", x.hint, x.text, diff)
+		}
+	}
+	for _, x := range []struct{ hint, text, drawn, rest string }{
+		{"ab", "日本語/ファイル.txt", "ab", "日本語/ファイル.t"},
+		{"abc", "ファイル", "abc ", "ファ"},
+		{"ab", "x😀", "ab", "x"},
+		{"abc", "é", "abc", ""},
+		{"🍎", "file.txt", "🍎", "file.t"},
+	} {
+		drawn, rest := overlay_hint_at_end(x.hint, x.text)
+		if diff := cmp.Diff([]string{x.drawn, x.rest}, []string{drawn, rest}); diff != "" {
+			t.Fatalf("Incorrect overlay at end of %#v on %#v:\n%s", x.hint, x.text, diff)
+		}
+	}
+}
+
+func TestWindowCols(t *testing.T) {
+	for val, expected := range map[string]int{"80": 80, "100000": 100000, "0": -1, "-5": -1, "": -1, "x": -1} {
+		if cols, ok := overlaid_window_cols(val); (ok && cols != expected) || ok != (expected > 0) {
+			t.Fatalf("Unexpected columns for %#v: %d %v", val, cols, ok)
+		}
+	}
+	for _, cols := range []int{0, -5} {
+		if actual := convert_text("ab\n\ncd", cols); actual != "ab\n\ncd" {
+			t.Fatalf("Unexpected text for %d columns: %#v", cols, actual)
+		}
+	}
+	if actual := convert_text("ab\ncd", 1000); actual != "ab"+strings.Repeat("\x00", 998)+"\ncd"+strings.Repeat("\x00", 998) {
+		t.Fatalf("Unexpected text for 1000 columns: %#v", actual)
+	}
+}
+
+func TestTabExpansion(t *testing.T) {
+	for _, x := range []struct {
+		line      string
+		tab_width int
+		expected  string
+	}{
+		{"a\tb", 8, "a       b"},
+		{"\tb\tc", 4, "    b   c"},
+		{"日本\tx", 8, "日本    x"},
+		{"a\tb", 0, "a\tb"},
+	} {
+		if actual := expand_tabs(x.line, x.tab_width); actual != x.expected {
+			t.Fatalf("Incorrect expansion of %#v: %#v != %#v", x.line, actual, x.expected)
+		}
+	}
+	text := convert_text_with_tab_width("x\thttp://a.com\n\ty", 30, 8)
+	_, marks, _, err := FindMarks(text, &Options{Type: "url", UrlPrefixes: "default", Regex: kitty.HintsDefaultRegex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marks[0].Start != 8 || marks[0].Text != "http://a.com" {
+		t.Fatalf("Incorrect mark after tab expansion: %#v", marks[0])
+	}
+	if lines := strings.Split(text, "\n"); len(lines[0]) != 30 || !strings.HasPrefix(lines[1], "        y") {
+		t.Fatalf("Incorrect padding after tab expansion: %#v", text)
+	}
+}
+
+func TestTypeColors(t *testing.T) {
+	colors := []string{"path:fg=red", "url: fg=black bg=cyan"}
+	for _, x := range []struct{ mark_type, expected string }{
+		{"url", "fg=black bg=cyan bold"},
+		{"path", "fg=red bold"},
+		{"word", "fg=white bg=green bold"},
+	} {
+		actual, err := hint_style_for_type(colors, x.mark_type, "white", "green")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != x.expected {
+			t.Fatalf("Unexpected style for %s: %#v != %#v", x.mark_type, actual, x.expected)
+		}
+	}
+	if _, err := hint_style_for_type([]string{"url"}, "url", "white", "green"); err == nil {
+		t.Fatalf("No error for invalid type color")
+	}
+}
+
+func BenchmarkHints(b *testing.B) {
+	const num_of_marks = 500
+	typed := encode_hint(num_of_marks/2, DEFAULT_HINT_ALPHABET, 0)[:1]
+	// the work done per key press, checking which marks match the typed input
+	b.Run("uncached", func(b *testing.B) {
+		for b.Loop() {
+			for i := range num_of_marks {
+				_ = strings.HasPrefix(encode_hint(i, DEFAULT_HINT_ALPHABET, 0), typed)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		hints := hint_cache{}
+		for b.Loop() {
+			for i := range num_of_marks {
+				_ = strings.HasPrefix(hints.hint(i, DEFAULT_HINT_ALPHABET), typed)
+			}
+		}
+	})
+}
+
+// render_by_slicing is the previous implementation of splice_marks used to
+// check that the output is unchanged and to compare performance
+func render_by_slicing(text string, marks []Mark, replace func(m *Mark, mark_text string) (string, bool)) string {
+	for i := len(marks) - 1; i >= 0; i-- {
+		m := &marks[i]
+		if r, ok := replace(m, text[m.Start:m.End]); ok {
+			text = text[:m.Start] + r + text[m.End:]
+		}
+	}
+	return text
+}
+
+func dense_marks(num_of_lines int) (string, []Mark) {
+	opts := &Options{Type: "word", MinimumMatchLength: 1}
+	text := convert_text(strings.Repeat("one two three four five six seven eight nine ten\n", num_of_lines), 60)
+	text, marks, _, err := FindMarks(text, opts)
+	if err != nil {
+		panic(err)
+	}
+	return text, marks
+}
+
+func TestSpliceMarks(t *testing.T) {
+	text, marks := dense_marks(20)
+	replace := func(m *Mark, mark_text string) (string, bool) {
+		if m.Index%3 == 0 {
+			return "", false
+		}
+		return fmt.Sprintf("\x1b[1m%d:%s\x1b[m", m.Index, mark_text), true
+	}
+	if diff := cmp.Diff(render_by_slicing(text, marks, replace), splice_marks(text, marks, replace)); diff != "" {
+		t.Fatalf("splice_marks output differs:\n%s", diff)
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	text, marks := dense_marks(500)
+	replace := func(m *Mark, mark_text string) (string, bool) { return "\x1b[1m" + mark_text + "\x1b[m", true }
+	b.Run("slicing", func(b *testing.B) {
+		for b.Loop() {
+			render_by_slicing(text, marks, replace)
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		for b.Loop() {
+			splice_marks(text, marks, replace)
+		}
+	})
+}
+
+func TestColorPreviewStyle(t *testing.T) {
+	if s := color_preview_style("#ffff0080"); s != "fg=#000000 bg=#ffff00 bold" {
+		t.Fatalf("Unexpected preview style: %#v", s)
+	}
+	if s := color_preview_style("#000080"); s != "fg=#ffffff bg=#000080 bold" {
+		t.Fatalf("Unexpected preview style: %#v", s)
+	}
+}
+
+func TestFormatMatch(t *testing.T) {
+	for _, x := range []struct {
+		text, suffix string
+		quote        bool
+		expected     string
+	}{
+		{"/a b/c", "", false, "/a b/c"},
+		{"/a/b.txt", " ", true, "/a/b.txt "},
+		{"/a b/c", " ", true, "'/a b/c' "},
+		{"it's", "", true, `'it'"'"'s'`},
+		{"$HOME/x", "", true, "'$HOME/x'"},
+	} {
+		if actual := format_match(x.text, x.suffix, x.quote); actual != x.expected {
+			t.Fatalf("Unexpected result for %#v: %#v != %#v", x.text, actual, x.expected)
+		}
+	}
+}
+
+func TestPageTarget(t *testing.T) {
+	rows := []int{0, 1, 1, 5, 9, 10, 30}
+	for _, x := range []struct{ current, page, expected int }{
+		{0, 5, 3},
+		{0, 10, 5},
+		{3, 10, 5},
+		{5, 10, 6},
+		{6, 10, 6},
+		{6, -10, 5},
+		{5, -10, 0},
+		{4, -5, 3},
+		{3, -1, 2},
+		{0, -10, 0},
+	} {
+		if actual := page_target(rows, x.current, x.page); actual != x.expected {
+			t.Fatalf("Unexpected page target from %d by %d: %d != %d", x.current, x.page, actual, x.expected)
+		}
+	}
+}
+
+func TestMoveSelection(t *testing.T) {
+	for _, x := range []struct{ position, count, step, expected int }{
+		{-1, 5, 1, 0},
+		{-1, 5, -1, 4},
+		{4, 5, 1, 0},
+		{0, 5, -1, 4},
+		{1, 5, 3, 4},
+		{3, 5, 3, 4},
+		{1, 5, -3, 0},
+		{-1, 5, 3, 2},
+	} {
+		if actual := move_selection(x.position, x.count, x.step); actual != x.expected {
+			t.Fatalf("Moving %d by %d of %d gave %d instead of %d", x.position, x.step, x.count, actual, x.expected)
+		}
+	}
+	if navigation_step(0) != 1 || navigation_step(NAVIGATION_ACCELERATION_DELAY-1) != 1 || navigation_step(NAVIGATION_ACCELERATION_DELAY) != 2 || navigation_step(1000) != NAVIGATION_MAX_STEP {
+		t.Fatalf("Unexpected navigation steps")
+	}
+}
+
+func TestNumberFilterSurvivors(t *testing.T) {
+	index_map := map[int]*Mark{}
+	for i, text := range []string{"foo", "bar", "food", "fool"} {
+		index_map[i] = &Mark{Index: i, Text: text}
+	}
+	matches := func(m *Mark) bool { return strings.HasPrefix(m.Text, "foo") }
+	// the chosen mark 0 does not take up a position
+	actual := number_filter_survivors(index_map, utils.NewSetWithItems(0), 1, matches)
+	if diff := cmp.Diff(map[int]int{2: 1, 3: 2}, actual); diff != "" {
+		t.Fatalf("Unexpected positions:\n%s", diff)
+	}
+	actual = number_filter_survivors(index_map, utils.NewSet[int](), 0, matches)
+	if diff := cmp.Diff(map[int]int{0: 0, 2: 1, 3: 2}, actual); diff != "" {
+		t.Fatalf("Unexpected positions:\n%s", diff)
+	}
+}
+
+func TestMarkAtCell(t *testing.T) {
+	// a badge before the hint and mark text, as rendered on screen
+	row := "ab \x1b[1m[3]\x1b[m\x1b]8;;mark:3\a\x1b[31mq\x1b[m\x1b[32mfoo.org\x1b[m\x1b]8;;\a 日" +
+		"\x1b]8;;mark:7\x1b\\x\x1b]8;;\x1b\\\x1b]8;;https://x.org\ay\x1b]8;;\a"
+	for _, x := range []struct{ col, expected int }{
+		{0, -1},
+		{2, -1},
+		{4, -1},
+		{6, 3},
+		{7, 3},
+		{13, 3},
+		{14, -1},
+		{16, -1},
+		{17, 7},
+		{18, -1},
+		{19, -1},
+		{-1, -1},
+	} {
+		if actual := mark_at_cell(row, x.col, "mark:"); actual != x.expected {
+			t.Fatalf("Unexpected mark for col %d: %d != %d", x.col, actual, x.expected)
+		}
+	}
+	if actual := mark_at_cell(row, 17, "m:"); actual != -1 {
+		t.Fatalf("Unexpected mark for a different prefix: %d", actual)
+	}
+}
+
+func TestSortChosen(t *testing.T) {
+	a, b, c := &Mark{Start: 5, Text: "b"}, &Mark{Start: 1, Text: "c"}, &Mark{Start: 9, Text: "a"}
+	chosen := []*Mark{a, b, c}
+	texts := func(marks []*Mark) string {
+		ans := ""
+		for _, m := range marks {
+			ans += m.Text
+		}
+		return ans
+	}
+	for how, expected := range map[string]string{"none": "bca", "position": "cba", "text": "abc"} {
+		if actual := texts(sort_chosen(chosen, how)); actual != expected {
+			t.Fatalf("Unexpected order for %s: %#v != %#v", how, actual, expected)
+		}
+	}
+	if texts(chosen) != "bca" {
+		t.Fatalf("sort_chosen modified its input")
+	}
+}
+
+func TestStripAnsi(t *testing.T) {
+	ls := "\x1b[0m\x1b[01;34mdir\x1b[0m  \x1b[01;32mrun.sh\x1b[0m\x1b[K\n\x1b(B\x1b[mfile.txt\x1b]2;title\a \x1b]8;;http://x.org\x1b\\link\x1b]8;;\x1b\\"
+	if diff := cmp.Diff("dir  run.sh\nfile.txt \x1b]8;;http://x.org\x1b\\link\x1b]8;;\x1b\\", strip_ansi(ls)); diff != "" {
+		t.Fatalf("Unexpected result:\n%s", diff)
+	}
+	_, marks, _, err := FindMarks(convert_text(strip_ansi(ls), 30), &Options{Type: "path"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"run.sh", "file.txt"}, utils.Map(func(m Mark) string { return m.Text }, marks)); diff != "" {
+		t.Fatalf("Unexpected paths:\n%s", diff)
+	}
+	_, marks, _, err = FindMarks(convert_text(strip_ansi(ls), 30), &Options{Type: "hyperlink"})
+	if err != nil || len(marks) != 1 || marks[0].Text != "http://x.org" {
+		t.Fatalf("Hyperlink not preserved: %#v %v", marks, err)
+	}
+}
+
+func TestAddToHistory(t *testing.T) {
+	var recent []string
+	for _, x := range []string{"a", "b", "c", "a"} {
+		recent = add_to_history(recent, x)
+	}
+	if diff := cmp.Diff([]string{"a", "c", "b"}, recent); diff != "" {
+		t.Fatalf("Unexpected history:\n%s", diff)
+	}
+	for i := range 2 * HISTORY_SIZE {
+		recent = add_to_history(recent, strconv.Itoa(i))
+	}
+	if len(recent) != HISTORY_SIZE || recent[0] != strconv.Itoa(2*HISTORY_SIZE-1) {
+		t.Fatalf("History not truncated: %#v", recent)
+	}
+}
+
+func TestBlendColors(t *testing.T) {
+	for _, x := range []struct {
+		a, b     uint32
+		t        float64
+		expected string
+	}{
+		{0xffffff, 0, 0.5, "#808080"},
+		{0xdddddd, 0x222222, 0.5, "#808080"},
+		{0xff0000, 0x0000ff, 0.25, "#bf0040"},
+		{0x123456, 0, 0, "#123456"},
+	} {
+		if actual := blend_colors(x.a, x.b, x.t); actual != x.expected {
+			t.Fatalf("Unexpected blend of %06x and %06x: %s != %s", x.a, x.b, actual, x.expected)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	for _, x := range []struct {
+		text, filter                 string
+		text_entry, case_insensitive bool
+		expected                     bool
+	}{
+		{"https://kitty.org", "KITTY", false, false, true},
+		{"https://kitty.org", "kitty", true, false, false},
+		{"https://kitty.org", "https://k", true, false, true},
+		{"https://kitty.org", "HTTPS", true, false, false},
+		{"https://kitty.org", "HTTPS", true, true, true},
+	} {
+		if actual := filter_matches(x.text, x.filter, x.text_entry, x.case_insensitive); actual != x.expected {
+			t.Fatalf("Unexpected filter result for %#v in %#v: %v", x.filter, x.text, actual)
+		}
+	}
+}
+
+func TestKeyBindings(t *testing.T) {
+	b, err := key_bindings([]string{"next:ctrl+n down", " quit : "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"ctrl+n", "down"}, b["next"]); diff != "" {
+		t.Fatalf("Unexpected keys for next:\n%s", diff)
+	}
+	if len(b["quit"]) != 0 {
+		t.Fatalf("Unexpected keys for disabled quit: %#v", b["quit"])
+	}
+	if diff := cmp.Diff(DEFAULT_KEY_BINDINGS["prev"], b["prev"]); diff != "" {
+		t.Fatalf("Unexpected keys for prev:\n%s", diff)
+	}
+	for _, x := range []string{"next", "unknown:x"} {
+		if _, err := key_bindings([]string{x}); err == nil {
+			t.Fatalf("No error for invalid binding: %#v", x)
+		}
+	}
+}
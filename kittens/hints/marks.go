@@ -4,12 +4,18 @@ package hints
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"os"
 	"os/exec"
 	"regexp"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,12 +29,14 @@ import (
 	"github.com/kovidgoyal/kitty/tools/config"
 	"github.com/kovidgoyal/kitty/tools/tty"
 	"github.com/kovidgoyal/kitty/tools/utils"
+	"github.com/kovidgoyal/kitty/tools/wcswidth"
 )
 
 var _ = fmt.Print
 
 const (
 	DEFAULT_HINT_ALPHABET = "0123456789abcdefghijklmnopqrstuvwxyz"
+	KEYPAD_HINT_ALPHABET  = "0123456789"
 	FILE_EXTENSION        = `\.(?:[a-zA-Z0-9]{2,7}|[ahcmo])(?:\b|[^.])`
 )
 
@@ -40,16 +48,45 @@ func default_linenum_regex() string {
 	return fmt.Sprintf(`(?P<path>%s):(?P<line>\d+)`, path_regex())
 }
 
+// Mark is a single match found by FindMarks
 type Mark struct {
-	Index        int            `json:"index"`
-	Start        int            `json:"start"`
-	End          int            `json:"end"`
-	Text         string         `json:"text"`
-	Group_id     string         `json:"group_id"`
-	Is_hyperlink bool           `json:"is_hyperlink"`
-	Groupdict    map[string]any `json:"groupdict"`
+	// The number of the mark, used to generate its hint, unique among all marks
+	Index int `json:"index"`
+	// The byte offsets of the match in the sanitized text returned by FindMarks
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// The text of the match, without line breaks, this is what is selected
+	Text         string `json:"text"`
+	Group_id     string `json:"group_id"`
+	Is_hyperlink bool   `json:"is_hyperlink"`
+	// Named groups from the pattern used to find the match and any extra
+	// information added by the matcher
+	Groupdict map[string]any `json:"groupdict"`
+	// What to do with the match when it is chosen, one of the MARK_ACTION_*
+	// values, empty means MARK_ACTION_SELECT
+	Action string `json:"action,omitempty"`
 }
 
+const (
+	MARK_ACTION_SELECT = "select"
+	MARK_ACTION_CLOSE  = "close"
+)
+
+// with_action returns a copy of the mark that performs the specified action
+// when chosen
+func (self *Mark) with_action(action string) *Mark {
+	ans := *self
+	ans.Action = action
+	return &ans
+}
+
+func (self *Mark) action() string {
+	return utils.IfElse(self.Action == "", MARK_ACTION_SELECT, self.Action)
+}
+
+// process_escape_codes removes SGR and OSC escape codes from text, returning a
+// mark for every OSC 8 hyperlink, covering the text of the hyperlink. OSC
+// codes can be terminated by either ST or BEL.
 func process_escape_codes(text string) (ans string, hyperlinks []Mark) {
 	removed_size, idx := 0, 0
 	active_hyperlink_url := ""
@@ -64,7 +101,7 @@ func process_escape_codes(text string) (ans string, hyperlinks []Mark) {
 		idx++
 	}
 
-	ans = utils.ReplaceAll(utils.MustCompile("\x1b(?:\\[[0-9;:]*?m|\\].*?\x1b\\\\)"), text, func(raw string, groupdict map[string]utils.SubMatch) string {
+	ans = utils.ReplaceAll(utils.MustCompile("\x1b(?:\\[[0-9;:]*?m|\\].*?(?:\x1b\\\\|\a))"), text, func(raw string, groupdict map[string]utils.SubMatch) string {
 		if !strings.HasPrefix(raw, "\x1b]8") {
 			removed_size += len(raw)
 			return ""
@@ -74,7 +111,7 @@ func process_escape_codes(text string) (ans string, hyperlinks []Mark) {
 		if active_hyperlink_url != "" {
 			add_hyperlink(start)
 		}
-		raw = raw[4 : len(raw)-2]
+		raw = strings.TrimSuffix(strings.TrimSuffix(raw[4:], "\a"), "\x1b\\")
 		if metadata, url, found := strings.Cut(raw, ";"); found && url != "" {
 			active_hyperlink_url = url
 			active_hyperlink_start_offset = start
@@ -155,6 +192,499 @@ func matching_remover(openers ...string) PostProcessorFunc {
 	}
 }
 
+var GIT_REMOTE_NAMES = []string{"origin", "upstream"}
+
+func git_ref_regex() string {
+	return `(?<![\w/.@~^-])(?P<ref>refs/[\w.-]+(?:/[\w.-]+)+|(?:` + strings.Join(GIT_REMOTE_NAMES, "|") + `)/[\w.-]+(?:/[\w.-]+)*|(?:HEAD|FETCH_HEAD|ORIG_HEAD|MERGE_HEAD)\b|v\d+(?:\.\d+){1,2}(?:-[\w.]+)?)(?P<suffix>(?:[~^]\d*)*)(?![\w/])`
+}
+
+func git_ref_group_processor(gd map[string]string) {
+	ref := gd["ref"]
+	if rest, found := strings.CutPrefix(ref, "refs/remotes/"); found {
+		gd["remote"], gd["ref"], _ = strings.Cut(rest, "/")
+	} else if rest, found := strings.CutPrefix(ref, "refs/heads/"); found {
+		gd["ref"] = rest
+	} else if rest, found := strings.CutPrefix(ref, "refs/tags/"); found {
+		gd["ref"] = rest
+	} else if remote, rest, found := strings.Cut(ref, "/"); found && slices.Contains(GIT_REMOTE_NAMES, remote) {
+		gd["remote"], gd["ref"] = remote, rest
+	}
+}
+
+func ip_group_processor(gd map[string]string) {
+	gd["family"] = utils.IfElse(strings.Contains(gd["address"], ":"), "v6", "v4")
+	if gd["prefix"] == "" {
+		delete(gd, "prefix")
+	}
+}
+
+func hash_group_processor(gd map[string]string) {
+	gd["short"] = gd["hash"][:min(12, len(gd["hash"]))]
+}
+
+func email_regex() string {
+	return `(?<![\w.%+-])(?P<user>[\w.%+-]+)@(?P<domain>(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?\.)+[a-zA-Z]{2,})\b`
+}
+
+func uuid_regex() string {
+	h := `[0-9a-fA-F]`
+	return fmt.Sprintf(`(?<![\w-])(?P<uuid>%[1]s{8}-%[1]s{4}-(?P<version>%[1]s)%[1]s{3}-%[1]s{4}-%[1]s{12})(?![\w-])`, h)
+}
+
+// semver_regex matches semantic versions, as specified at https://semver.org,
+// with an optional v prefix, but not dotted sequences of more than three numbers
+func semver_regex() string {
+	num := `(?:0|[1-9]\d*)`
+	ident := `(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)`
+	return fmt.Sprintf(`(?<![\w.+-])v?(?P<major>%[1]s)\.(?P<minor>%[1]s)\.(?P<patch>%[1]s)`+
+		`(?:-(?P<prerelease>%[2]s(?:\.%[2]s)*))?(?:\+(?P<build>[0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?(?![\w+-]|\.\d)`, num, ident)
+}
+
+// quoted_regex matches non-empty single, double and backtick quoted strings,
+// which can contain escaped quotes, but not line breaks
+func quoted_regex() string {
+	q := func(name, quote string) string {
+		return fmt.Sprintf(`%[2]s(?P<%[1]s>(?:[^%[2]s\\\n]|\\.)+)%[2]s`, name, quote)
+	}
+	return `(?<!\w)(?:` + q("dq", `"`) + "|" + q("sq", `'`) + "|" + q("bq", "`") + ")"
+}
+
+var quote_groups = map[string]string{"dq": `"`, "sq": `'`, "bq": "`"}
+
+func quoted_group_processor(gd map[string]string) {
+	for key, quote := range quote_groups {
+		if v, found := gd[key]; found {
+			gd["quote"], gd["contents"] = quote, v
+			delete(gd, key)
+		}
+	}
+}
+
+// CURRENCY_SYMBOLS are the symbols recognized before or after an amount by
+// the number type
+const CURRENCY_SYMBOLS = `$€£¥₹₽₩₪₺₿`
+
+// number_regex matches numbers and currency amounts, such as $1,234.56, 99€
+// and 1_000. currency is one of optional, required or none and separators
+// are the characters allowed between groups of thousands. Numbers that are
+// part of dotted or dashed sequences, such as versions, IP addresses and
+// dates, are not matched.
+func number_regex(currency, separators string) string {
+	amount := `\d+(?:\.\d+)?`
+	if separators != "" {
+		amount = fmt.Sprintf(`\d{1,3}(?:[%s]\d{3})+(?:\.\d+)?|`, regexp.QuoteMeta(separators)) + amount
+	}
+	sym := "[" + CURRENCY_SYMBOLS + "]"
+	number := fmt.Sprintf(`(?P<sign>[-+])?(?P<amount>%s)`, amount)
+	switch currency {
+	case "optional":
+		number = fmt.Sprintf(`(?P<sign>[-+])?(?P<currency>%s)?(?P<amount>%s)(?P<suffix>%s)?`, sym, amount, sym)
+	case "required":
+		number = fmt.Sprintf(`(?=[-+]?%s|[-+]?[\d.%s]+%s)(?P<sign>[-+])?(?P<currency>%s)?(?P<amount>%s)(?P<suffix>%s)?`, sym, regexp.QuoteMeta(separators), sym, sym, amount, sym)
+	}
+	return `(?<![\w.,:/-])` + number + `(?!\w|[.,:/-]\d)`
+}
+
+// number_group_processor sets the value group to the amount without
+// separators, with any sign
+func number_group_processor(gd map[string]string) {
+	gd["value"] = gd["sign"] + strings.Map(func(ch rune) rune { return utils.IfElse(ch == '.' || unicode.IsDigit(ch), ch, -1) }, gd["amount"])
+	if s, found := gd["suffix"]; found {
+		gd["currency"] = s
+	}
+	delete(gd, "sign")
+	delete(gd, "amount")
+	delete(gd, "suffix")
+}
+
+// phone_regex matches phone numbers made up of groups of digits separated by
+// spaces, dashes or dots, with an optional country code and area code in
+// parentheses. Runs of digits without separators are not matched.
+func phone_regex() string {
+	return `(?<![\w+.-])(?P<number>(?:\+(?P<country>\d{1,3})[ .-]?)?(?:\(\d{1,4}\)[ .-]?|\d{1,4}[ .-])\d{2,4}(?:[ .-]\d{2,4}){1,3})(?![\w-]|\.\d)`
+}
+
+func phone_group_processor(gd map[string]string) {
+	if gd["country"] != "" {
+		gd["e164"] = "+" + utils.MustCompile(`\D`).ReplaceAllString(gd["number"], "")
+	}
+}
+
+func color_regex() string {
+	return `(?<![\w#&])(?P<color>#(?:[0-9a-fA-F]{8}|[0-9a-fA-F]{6}|[0-9a-fA-F]{3,4})(?![\w-])|(?:rgba?|hsla?)\([^()\n]{1,64}\))`
+}
+
+// css_color_to_hex converts a CSS hex, rgb(), rgba(), hsl() or hsla() color to
+// the form #rrggbb, with an alpha component appended if it is not opaque
+func css_color_to_hex(spec string) (ans string, ok bool) {
+	spec = strings.ToLower(strings.ReplaceAll(spec, "\r", ""))
+	if h, found := strings.CutPrefix(spec, "#"); found {
+		if len(h) < 5 {
+			var b strings.Builder
+			for _, ch := range h {
+				b.WriteRune(ch)
+				b.WriteRune(ch)
+			}
+			h = b.String()
+		}
+		if len(h) == 8 && strings.HasSuffix(h, "ff") {
+			h = h[:6]
+		}
+		return "#" + h, true
+	}
+	name, args, _ := strings.Cut(strings.TrimSuffix(spec, ")"), "(")
+	parts := strings.FieldsFunc(args, func(r rune) bool { return r == ',' || r == '/' || unicode.IsSpace(r) })
+	if len(parts) != 3 && len(parts) != 4 {
+		return
+	}
+	// component parses a number or percentage, scaling percentages to scale
+	component := func(x string, scale float64) (float64, bool) {
+		pc := strings.HasSuffix(x, "%")
+		v, err := strconv.ParseFloat(strings.TrimSuffix(x, "%"), 64)
+		if err != nil {
+			return 0, false
+		}
+		return utils.IfElse(pc, v*scale/100, v), true
+	}
+	var vals [4]float64
+	vals[3] = 1
+	for i, x := range parts {
+		var scale float64
+		switch {
+		case i == 3:
+			scale = 1
+		case strings.HasPrefix(name, "hsl") && i == 0:
+			x = strings.TrimSuffix(x, "deg")
+			scale = 360
+		case strings.HasPrefix(name, "hsl"):
+			if !strings.HasSuffix(x, "%") {
+				return
+			}
+			scale = 1
+		default:
+			scale = 255
+		}
+		if vals[i], ok = component(x, scale); !ok {
+			return
+		}
+	}
+	if strings.HasPrefix(name, "hsl") {
+		h, s, l := math.Mod(math.Mod(vals[0], 360)+360, 360)/60, min(max(vals[1], 0), 1), min(max(vals[2], 0), 1)
+		c := (1 - math.Abs(2*l-1)) * s
+		x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+		var r, g, b float64
+		switch int(h) {
+		case 0:
+			r, g, b = c, x, 0
+		case 1:
+			r, g, b = x, c, 0
+		case 2:
+			r, g, b = 0, c, x
+		case 3:
+			r, g, b = 0, x, c
+		case 4:
+			r, g, b = x, 0, c
+		default:
+			r, g, b = c, 0, x
+		}
+		m := l - c/2
+		vals[0], vals[1], vals[2] = (r+m)*255, (g+m)*255, (b+m)*255
+	}
+	as_byte := func(v float64) int { return int(math.Round(min(max(v, 0), 255))) }
+	ans = fmt.Sprintf("#%02x%02x%02x", as_byte(vals[0]), as_byte(vals[1]), as_byte(vals[2]))
+	if alpha := as_byte(vals[3] * 255); alpha < 255 {
+		ans += fmt.Sprintf("%02x", alpha)
+	}
+	return ans, true
+}
+
+func color_group_processor(gd map[string]string) {
+	gd["hex"], _ = css_color_to_hex(gd["color"])
+}
+
+func base64_regex(min_length int) string {
+	return fmt.Sprintf(`(?<![\w+/-])(?P<blob>[a-zA-Z0-9+/]{%d,}={0,2})(?![\w+/=-])`, max(4, min_length))
+}
+
+func decode_base64(blob string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(blob, "="))
+}
+
+// base64_group_processor adds the decoded text, if it is valid UTF-8 without
+// control characters other than whitespace
+func base64_group_processor(gd map[string]string) {
+	if b, err := decode_base64(gd["blob"]); err == nil && utf8.Valid(b) {
+		decoded := string(b)
+		if !strings.ContainsFunc(decoded, func(r rune) bool { return unicode.IsControl(r) && !unicode.IsSpace(r) }) {
+			gd["decoded"] = decoded
+		}
+	}
+}
+
+// K8S_KINDS are the Kubernetes resource kinds, with their plural and short
+// names, recognized before the name of a resource by the k8s type
+var K8S_KINDS = []string{
+	"pods?", "po", "deployments?", "deploy", "services?", "svc", "replicasets?", "rs", "statefulsets?", "sts",
+	"daemonsets?", "ds", "jobs?", "cronjobs?", "cj", "configmaps?", "cm", "secrets?", "ingress(?:es)?", "ing",
+	"nodes?", "no", "namespaces?", "ns", "persistentvolumeclaims?", "pvc", "persistentvolumes?", "pv",
+	"serviceaccounts?", "sa", "endpoints", "ep", "horizontalpodautoscalers?", "hpa", "networkpolic(?:y|ies)",
+	"netpol", "roles?", "rolebindings?", "clusterroles?", "clusterrolebindings?", "storageclass(?:es)?", "sc",
+	"events?", "ev", "poddisruptionbudgets?", "pdb", "customresourcedefinitions?", "crds?",
+}
+
+// k8s_regex matches Kubernetes resources of the form kind/name, where kind
+// can have an API group, such as deployment.apps/web, and namespace/name. To
+// not match parts of paths, the namespace form only matches names without
+// dots and neither form matches inside longer paths.
+func k8s_regex() string {
+	label := `[a-z0-9](?:[-a-z0-9]*[a-z0-9])?`
+	return fmt.Sprintf(`(?<![\w./~-])(?:(?:(?P<kind>%s)(?:\.(?P<group>%s(?:\.%s)*))?/(?P<name>[a-z0-9](?:[-a-z0-9.]*[a-z0-9])?))|(?P<namespace>%s)/(?P<pod>%s))(?![\w/-]|\.\w)`,
+		strings.Join(K8S_KINDS, "|"), label, label, label, label)
+}
+
+// k8s_group_processor sets the name group for the namespace/name form, which
+// is most often used for pods
+func k8s_group_processor(gd map[string]string) {
+	if pod, found := gd["pod"]; found {
+		gd["name"] = pod
+		delete(gd, "pod")
+	}
+}
+
+// image_regex matches container image references with a tag, a digest or both,
+// such as registry:5000/org/repo:tag@sha256:hex. The first path component is
+// the registry only if it contains a dot or a port or is localhost, as for
+// docker, so that repo:tag is not mistaken for host:port.
+func image_regex() string {
+	registry := `(?:[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*:\d+|[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)+|localhost)`
+	component := `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+	tag := `\w[\w.-]{0,127}`
+	digest := `[a-zA-Z][a-zA-Z0-9]*(?:[-_+.][a-zA-Z][a-zA-Z0-9]*)*:[0-9a-fA-F]{32,}`
+	return fmt.Sprintf(`(?<![\w./:@-])(?:(?P<registry>%s)/)?(?P<repository>%s(?:/%s)*)(?:(?::(?P<tag>%s))(?:@(?P<digest>%s))?|@(?P<digest2>%s))(?![\w/:@])`,
+		registry, component, component, tag, digest, digest)
+}
+
+func image_group_processor(gd map[string]string) {
+	if d, ok := gd["digest2"]; ok {
+		gd["digest"] = d
+		delete(gd, "digest2")
+	}
+}
+
+// issue_regex matches Jira style PROJECT-123 and GitHub style #123 and
+// owner/repo#123 issue references
+func issue_regex() string {
+	return `(?<![\w-])(?P<project>[A-Z][A-Z0-9]+)-(?P<jnumber>\d+)(?![\w-])|(?<![\w/#&])(?P<repo>[\w.-]+/[\w.-]+)?#(?P<gnumber>\d+)(?!\w)`
+}
+
+func issue_group_processor(gd map[string]string) {
+	gd["number"] = gd["jnumber"] + gd["gnumber"]
+	delete(gd, "jnumber")
+	delete(gd, "gnumber")
+}
+
+// issue_url expands the first of templates for which the groupdict has a
+// value for every {name} field
+func issue_url(templates []string, gd map[string]any) string {
+	field := utils.MustCompile(`\{(\w+)\}`)
+	for _, t := range templates {
+		ok := true
+		ans := field.ReplaceAllStringFunc(t, func(x string) string {
+			v, _ := gd[x[1:len(x)-1]].(string)
+			ok = ok && v != ""
+			return v
+		})
+		if ok {
+			return ans
+		}
+	}
+	return ""
+}
+
+// Keywords that are commonly followed by a parenthesis but are not calls
+var CALL_KEYWORDS = utils.NewSetWithItems("if", "for", "while", "switch", "return", "catch", "elif", "and", "or", "not", "in", "sizeof", "typeof", "func", "function", "def")
+
+// call_regex matches an identifier immediately followed by an opening
+// parenthesis along with any receiver or namespace before it, such as
+// foo.Bar( or pkg::method(, the parenthesis is not part of the match
+func call_regex() string {
+	ident := `[a-zA-Z_]\w*`
+	return fmt.Sprintf(`(?<![\w$])(?P<receiver>(?:%s(?:\.|::|->))+)?(?P<name>%s)(?=\()`, ident, ident)
+}
+
+func call_group_processor(gd map[string]string) {
+	if r, ok := gd["receiver"]; ok {
+		for _, sep := range []string{".", "::", "->"} {
+			r = strings.TrimSuffix(r, sep)
+		}
+		gd["receiver"] = r
+	}
+}
+
+// IMPORT_LANGUAGE_PATTERNS has the patterns for the import syntaxes of each
+// language, the match is only the module specifier, the rest of the statement
+// is matched with lookarounds. The names of the groups are language_kind.
+var IMPORT_LANGUAGE_PATTERNS = map[string]string{
+	"js": `(?<=(?<![\w$.])(?:import|export)[ \t]+(?:[\w$*{},\s\x00]+?[\s\x00]from[ \t]*)?['"])(?P<js_import>[^'"\s\x00]+)(?=['"])` +
+		`|(?<=(?<![\w$.])import\([ \t]*['"])(?P<js_dynamic>[^'"\s\x00]+)(?=['"])` +
+		`|(?<=(?<![\w$.])require\([ \t]*['"])(?P<js_require>[^'"\s\x00]+)(?=['"])`,
+	"css": `(?<=@import[ \t]+(?:url\([ \t]*)?['"]?)(?P<css_import>[^'"\s\x00()]+)(?=['")]|[ \t]*;)`,
+	"python": `(?m:(?<=^[ \t\x00]*from[ \t]+)(?P<python_from>\.+(?:\w[\w.]*)?|\w[\w.]*)(?=[ \t]+import\b))` +
+		`|(?m:(?<=^[ \t\x00]*import[ \t]+)(?P<python_import>\w[\w.]*)(?![^\n]*\bfrom[ \t]*['"]))`,
+	"go":   `(?<=(?<!\w)import[ \t]+(?:[\w.]+[ \t]+)?"|(?<!\w)import[ \t]*\((?:[\s\x00]*(?:(?:[\w.]+[ \t]+)?"[^"\n]*"|//[^\n]*))*[\s\x00]*(?:[\w.]+[ \t]+)?")(?P<go_import>[^"\s\x00]+)(?=")`,
+	"rust": `(?<=(?<!\w)use[ \t]+)(?P<rust_use>(?:::)?\w+(?:::\w+)*)(?=;|::\{|::\*|[ \t]+as\b)`,
+}
+
+func import_languages(opts *Options) (ans []string, err error) {
+	for x := range strings.SplitSeq(opts.ImportLanguages, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			if _, found := IMPORT_LANGUAGE_PATTERNS[x]; !found {
+				return nil, fmt.Errorf("Unknown import language: %#v", x)
+			}
+			ans = append(ans, x)
+		}
+	}
+	if len(ans) == 0 {
+		err = fmt.Errorf("No import languages specified")
+	}
+	return
+}
+
+func import_regex(languages []string) string {
+	return strings.Join(utils.Map(func(x string) string { return IMPORT_LANGUAGE_PATTERNS[x] }, languages), "|")
+}
+
+// import_group_processor replaces the group of the import syntax that matched
+// with the specifier, language and kind groups
+func import_group_processor(gd map[string]string) {
+	for key, v := range gd {
+		if language, kind, found := strings.Cut(key, "_"); found {
+			if _, known := IMPORT_LANGUAGE_PATTERNS[language]; known {
+				gd["specifier"], gd["language"], gd["kind"] = v, language, kind
+				delete(gd, key)
+			}
+		}
+	}
+}
+
+// socket_regex matches host:port where host is an IPv4 address, an IPv6
+// address in brackets, localhost or a hostname with at least one dot. The port
+// ends at the first non-digit, so that for URLs the path is not included.
+func socket_regex() string {
+	ipv4 := `(?:\d{1,3}\.){3}\d{1,3}`
+	ipv6 := `\[[a-fA-F0-9:.]+\]`
+	hostname := `localhost|(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?\.)+[a-zA-Z][a-zA-Z0-9-]*[a-zA-Z0-9]`
+	return fmt.Sprintf(`(?<![\w.:\[-])(?P<host>%s|%s|%s):(?P<port>\d{1,5})(?!\d)`, ipv6, ipv4, hostname)
+}
+
+func socket_group_processor(gd map[string]string) {
+	gd["host"] = strings.TrimSuffix(strings.TrimPrefix(gd["host"], "["), "]")
+}
+
+func keyvalue_regex() string {
+	return `(?<![\w./-])(?P<key>[a-zA-Z_][\w.-]*)(?:[ \t]*=[ \t]*|:[ \t]+)(?P<value>"(?:[^"\\\n]|\\.)*"|'[^'\n]*'|[^\s\x00"'&]+)`
+}
+
+func keyvalue_group_processor(gd map[string]string) {
+	v := gd["value"]
+	if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		} else {
+			v = v[1 : len(v)-1]
+		}
+	} else if len(v) > 1 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		v = v[1 : len(v)-1]
+	}
+	gd["value"] = v
+}
+
+var ESCAPE_FAMILY_PATTERNS = map[string]string{
+	"percent":   `%[0-9a-fA-F]{2}`,
+	"backslash": `\\(?:x[0-9a-fA-F]{2}|u[0-9a-fA-F]{4}|[nrt0\\"'])`,
+	"html":      `&(?:#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`,
+}
+
+func escape_families(opts *Options) (ans []string, err error) {
+	for x := range strings.SplitSeq(opts.EscapeFamilies, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			if _, found := ESCAPE_FAMILY_PATTERNS[x]; !found {
+				return nil, fmt.Errorf("Unknown escape family: %#v", x)
+			}
+			ans = append(ans, x)
+		}
+	}
+	if len(ans) == 0 {
+		err = fmt.Errorf("No escape families specified")
+	}
+	return
+}
+
+func escaped_regex(families []string) string {
+	return `[^\s\x00]*(?:` + strings.Join(utils.Map(func(x string) string { return ESCAPE_FAMILY_PATTERNS[x] }, families), "|") + `)[^\s\x00]*`
+}
+
+func decode_escapes(text string, families []string) string {
+	for _, family := range families {
+		switch family {
+		case "percent":
+			text = utils.MustCompile(`(?:%[0-9a-fA-F]{2})+`).ReplaceAllStringFunc(text, func(m string) string {
+				ans, _ := url.PathUnescape(m)
+				return ans
+			})
+		case "backslash":
+			text = utils.MustCompile(ESCAPE_FAMILY_PATTERNS["backslash"]).ReplaceAllStringFunc(text, func(m string) string {
+				switch m[1] {
+				case 'n':
+					return "\n"
+				case 'r':
+					return "\r"
+				case 't':
+					return "\t"
+				case '0':
+					return "\x00"
+				case 'x', 'u':
+					n, _ := strconv.ParseUint(m[2:], 16, 32)
+					return string(rune(n))
+				}
+				return m[1:]
+			})
+		case "html":
+			text = html.UnescapeString(text)
+		}
+	}
+	return text
+}
+
+// traceback_regex matches the frames of Go, Python and Node.js stack traces,
+// each frame being a single match. For Go that includes the line with the
+// function before the file.go:line line, when present.
+func traceback_regex() string {
+	golang := `(?:^(?P<function>[^\s\x00]+)\([^()\n]*\)[ \x00]*\n[ \t]+|(?<=^[ \t]+))(?P<file>[^\s:\x00]+\.go):(?P<line>\d+)(?= \+0x[0-9a-f]+|[\s\x00]|$)`
+	python := `(?<=^[ \t\x00]*)File "(?P<file>[^"\n]+)", line (?P<line>\d+)(?:, in (?P<function>[^\s\x00]+))?`
+	node := `(?<=^[ \t\x00]*at )(?:(?:async )?(?P<function>[^\s(\x00][^(\n]*?) \()?(?P<file>(?:file://)?[^\s():\x00]+):(?P<line>\d+):(?P<column>\d+)\)?`
+	return `(?m)` + golang + "|" + python + "|" + node
+}
+
+func traceback_group_processor(gd map[string]string) {
+	gd["file"] = strings.TrimPrefix(gd["file"], "file://")
+	// the path is used by --linenum-action
+	gd["path"] = utils.Expanduser(gd["file"])
+}
+
+// fileloc_regex matches path:line[:column] as printed by compilers, where path
+// can be a relative path or a Windows path with a drive letter
+func fileloc_regex() string {
+	return `(?<![\w.~/\\:-])(?!\d+:)(?P<path>(?:[a-zA-Z]:[\\/])?[^\s:\x00"'()\[\]<>]+):(?P<line>\d+)(?::(?P<column>\d+))?(?!\d)`
+}
+
+func fileloc_group_processor(gd map[string]string) {
+	gd[`path`] = utils.Expanduser(gd[`path`])
+	if gd["column"] == "" {
+		delete(gd, "column")
+	}
+}
+
 func linenum_group_processor(gd map[string]string) {
 	pat := utils.MustCompile(`:\d+$`)
 	gd[`path`] = pat.ReplaceAllStringFunc(gd["path"], func(m string) string {
@@ -192,11 +722,64 @@ var PostProcessorMap = sync.OnceValue(func() map[string]PostProcessorFunc {
 			return s, e
 		},
 
+		"trailing_punctuation": func(text string, s, e int) (int, int) {
+			for e > s+1 && is_punctuation(char_at(text, e-1)) {
+				e--
+			}
+			return s, e
+		},
+
 		"brackets": matching_remover("(", "{", "[", "<"),
 		"quotes":   matching_remover("'", `"`, "“", "‘"),
 		"ip": func(text string, s, e int) (int, int) {
-			addr := ipaddr.NewHostName(text[s:e])
-			if !addr.IsAddress() {
+			addr, prefix, has_prefix := strings.Cut(text[s:e], "/")
+			if !ipaddr.NewHostName(addr).IsAddress() {
+				return -1, -1
+			}
+			if has_prefix {
+				if n, err := strconv.Atoi(prefix); err != nil || n > utils.IfElse(strings.Contains(addr, ":"), 128, 32) {
+					return -1, -1
+				}
+			}
+			return s, e
+		},
+		"socket": func(text string, s, e int) (int, int) {
+			idx := strings.LastIndexByte(text[s:e], ':')
+			if port, err := strconv.Atoi(text[s+idx+1 : e]); err != nil || port < 1 || port > 65535 {
+				return -1, -1
+			}
+			return s, e
+		},
+		"color": func(text string, s, e int) (int, int) {
+			if _, ok := css_color_to_hex(text[s:e]); !ok {
+				return -1, -1
+			}
+			return s, e
+		},
+		"base64": func(text string, s, e int) (int, int) {
+			// random data almost always has both upper and lower case
+			// letters, unlike words, paths and hex hashes
+			blob := text[s:e]
+			if !strings.ContainsFunc(blob, unicode.IsUpper) || !strings.ContainsFunc(blob, unicode.IsLower) {
+				return -1, -1
+			}
+			if _, err := decode_base64(blob); err != nil {
+				return -1, -1
+			}
+			return s, e
+		},
+		"call": func(text string, s, e int) (int, int) {
+			name := utils.MustCompile(`\w+$`).FindString(text[s:e])
+			if CALL_KEYWORDS.Has(name) {
+				return -1, -1
+			}
+			return s, e
+		},
+		"phone": func(text string, s, e int) (int, int) {
+			// reject implausible numbers of digits and dates
+			number := text[s:e]
+			digits := len(utils.MustCompile(`\d`).FindAllStringIndex(number, -1))
+			if digits < 7 || digits > 15 || utils.MustCompile(`^\d{4}[.-]\d{2}[.-]\d{2}$`).MatchString(number) {
 				return -1, -1
 			}
 			return s, e
@@ -367,16 +950,97 @@ func functions_for(opts *Options) (pattern string, post_processors []PostProcess
 		pattern = path_regex()
 		post_processors = append(post_processors, PostProcessorMap()["brackets"], PostProcessorMap()["quotes"])
 	case "line":
-		pattern = "(?m)^\\s*(.+)[\\s\x00]*$"
+		// every non-blank logical line, including soft wrapped continuations,
+		// without surrounding blanks
+		pattern = `(?m)(?<=^[ \t\x00]*)[^\s\x00](?:[^\n]*[^\s\x00])?`
+	case "git-ref":
+		pattern = git_ref_regex()
+		post_processors = append(post_processors, PostProcessorMap()["trailing_punctuation"])
+		group_processors = append(group_processors, git_ref_group_processor)
+	case "escaped":
+		var families []string
+		if families, err = escape_families(opts); err != nil {
+			return
+		}
+		pattern = escaped_regex(families)
+		post_processors = append(post_processors, PostProcessorMap()["trailing_punctuation"])
+	case "import":
+		var languages []string
+		if languages, err = import_languages(opts); err != nil {
+			return
+		}
+		pattern = import_regex(languages)
+		group_processors = append(group_processors, import_group_processor)
+	case "email":
+		pattern = email_regex()
+	case "uuid":
+		pattern = uuid_regex()
+	case "semver":
+		pattern = semver_regex()
+	case "color":
+		pattern = color_regex()
+		post_processors = append(post_processors, PostProcessorMap()["color"])
+		group_processors = append(group_processors, color_group_processor)
+	case "k8s":
+		pattern = k8s_regex()
+		group_processors = append(group_processors, k8s_group_processor)
+	case "image":
+		pattern = image_regex()
+		post_processors = append(post_processors, PostProcessorMap()["trailing_punctuation"])
+		group_processors = append(group_processors, image_group_processor)
+	case "issue":
+		pattern = issue_regex()
+		group_processors = append(group_processors, issue_group_processor)
+	case "base64":
+		pattern = base64_regex(opts.Base64MinLength)
+		post_processors = append(post_processors, PostProcessorMap()["base64"])
+		group_processors = append(group_processors, base64_group_processor)
+	case "call":
+		pattern = call_regex()
+		post_processors = append(post_processors, PostProcessorMap()["call"])
+		group_processors = append(group_processors, call_group_processor)
+	case "socket":
+		pattern = socket_regex()
+		post_processors = append(post_processors, PostProcessorMap()["socket"])
+		group_processors = append(group_processors, socket_group_processor)
+	case "number":
+		pattern = number_regex(opts.NumberCurrency, opts.NumberSeparators)
+		group_processors = append(group_processors, number_group_processor)
+	case "phone":
+		pattern = phone_regex()
+		post_processors = append(post_processors, PostProcessorMap()["phone"])
+		group_processors = append(group_processors, phone_group_processor)
+	case "quoted":
+		pattern = quoted_regex()
+		group_processors = append(group_processors, quoted_group_processor)
+	case "traceback":
+		pattern = traceback_regex()
+		group_processors = append(group_processors, traceback_group_processor)
+	case "fileloc":
+		pattern = fileloc_regex()
+		group_processors = append(group_processors, fileloc_group_processor)
+	case "keyvalue", "kv":
+		if opts.Group != "" && opts.Group != "key" && opts.Group != "value" && opts.Group != "pair" {
+			err = fmt.Errorf("The --group for the %s type must be one of key, value or pair, not: %#v", opts.Type, opts.Group)
+			return
+		}
+		pattern = keyvalue_regex()
+		group_processors = append(group_processors, keyvalue_group_processor)
 	case "hash":
-		pattern = "[0-9a-f][0-9a-f\r]{6,127}"
+		// git hashes are at most forty digits, longer runs of hex digits are
+		// other things, such as checksums
+		pattern = fmt.Sprintf("(?<!\\w)(?P<hash>[0-9a-f][0-9a-f\r]{%d,39})(?!\\w)", min(max(1, opts.HashMinLength), 40)-1)
+		group_processors = append(group_processors, hash_group_processor)
 	case "ip":
-		pattern = (
-		// IPv4 with no validation
-		`((?:\d{1,3}\.){3}\d{1,3}` + "|" +
+		pattern = (`(?<![\w.:])(?P<address>` +
+			// IPv4 with no validation
+			`(?:\d{1,3}\.){3}\d{1,3}` + "|" +
 			// IPv6 with no validation
-			`(?:[a-fA-F0-9]{0,4}:){2,7}[a-fA-F0-9]{1,4})`)
+			`(?:[a-fA-F0-9]{0,4}:){2,7}[a-fA-F0-9]{1,4})` +
+			// optional CIDR prefix length, not part of a longer dotted sequence
+			`(?:/(?P<prefix>\d{1,3}))?(?!\d|\.\d)`)
 		post_processors = append(post_processors, PostProcessorMap()["ip"])
+		group_processors = append(group_processors, ip_group_processor)
 	default:
 		pattern = opts.Regex
 		if opts.Type == "linenum" {
@@ -515,11 +1179,11 @@ func mark(r *regexp2.Regexp, post_processors []PostProcessorFunc, group_processo
 		full_match = sanitize_pat.ReplaceAllLiteralString(text[match_start:match_end], "")
 		gd := make(map[string]string, len(m.Groups))
 		for idx, g := range m.Groups {
-			if idx > 0 && g.IsNamed {
+			if idx > 0 && g.IsNamed && len(g.Captures) > 0 {
 				c := g.LastCapture()
 				if s, e := c.Byte_Offsets.Start, c.Byte_Offsets.End; s > -1 && e > -1 {
 					s = max(s, match_start)
-					e = min(e, match_end)
+					e = max(s, min(e, match_end))
 					gd[g.Name] = sanitize_pat.ReplaceAllLiteralString(text[s:e], "")
 				}
 			}
@@ -531,7 +1195,16 @@ func mark(r *regexp2.Regexp, post_processors []PostProcessorFunc, group_processo
 		for k, v := range gd {
 			gd2[k] = v
 		}
-		if opts.Type == "regex" && len(m.Groups) > 1 && !m.HasNamedGroups() {
+		if opts.Type == "regex" && opts.Group != "" {
+			idx := slices.IndexFunc(m.Groups, func(g Group) bool { return g.IsNamed && g.Name == opts.Group })
+			if idx < 0 || len(m.Groups[idx].Captures) == 0 {
+				continue
+			}
+			cp := m.Groups[idx].LastCapture()
+			match_start = max(match_start, cp.Byte_Offsets.Start)
+			match_end = max(match_start, min(match_end, cp.Byte_Offsets.End))
+			full_match = sanitize_pat.ReplaceAllLiteralString(text[match_start:match_end], "")
+		} else if opts.Type == "regex" && len(m.Groups) > 1 && !m.HasNamedGroups() {
 			cp := m.Groups[1].LastCapture()
 			ms, me := cp.Byte_Offsets.Start, cp.Byte_Offsets.End
 			match_start = max(match_start, ms)
@@ -614,6 +1287,186 @@ func mark_words(text string, opts *Options) (ans []Mark) {
 	return
 }
 
+// mark_log_entries creates a mark for each logical log entry, made up of a
+// header line followed by any continuation lines
+func mark_log_entries(text string, opts *Options) (ans []Mark, err error) {
+	continuation, err := regexp2.Compile(opts.ContinuationPattern, regexp2.RE2)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compile the continuation pattern: %#v with error: %w", opts.ContinuationPattern, err)
+	}
+	var current struct {
+		lines      []string
+		start, end int
+	}
+	commit_entry := func() {
+		if len(current.lines) > 0 {
+			full_match := strings.Join(current.lines, "\n")
+			if len([]rune(full_match)) >= opts.MinimumMatchLength {
+				ans = append(ans, Mark{Index: len(ans), Start: current.start, End: current.end, Text: full_match, Groupdict: map[string]any{}})
+			}
+		}
+		current.lines = nil
+	}
+	pos := 0
+	for line := range strings.SplitSeq(text, "\n") {
+		line_start := pos
+		pos += len(line) + 1
+		clean := strings.TrimRight(strings.NewReplacer("\r", "", "\x00", "").Replace(line), " ")
+		if strings.TrimSpace(clean) == "" {
+			commit_entry()
+			continue
+		}
+		is_continuation, err := continuation.MatchString(clean)
+		if err != nil {
+			return nil, err
+		}
+		if !is_continuation || len(current.lines) == 0 {
+			commit_entry()
+			current.start = line_start
+		}
+		current.lines = append(current.lines, clean)
+		current.end = line_start + len(strings.TrimRight(line, "\x00\r"))
+	}
+	commit_entry()
+	return
+}
+
+// markdown_link_at parses a markdown inline link of the form [label](url) or
+// [label](url "title") whose opening bracket is at text[start]. Returns the
+// offset just after the closing bracket of the label, the offset just after
+// the end of the link and the url, or -1 for the offsets if there is no link.
+func markdown_link_at(text string, start int) (label_end, end int, url string) {
+	depth := 0
+	label_end = -1
+	for i := start; i < len(text) && label_end < 0; i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\n':
+			return -1, -1, ""
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				label_end = i + 1
+			}
+		}
+	}
+	if label_end < 0 || label_end >= len(text) || text[label_end] != '(' {
+		return -1, -1, ""
+	}
+	// the url may contain balanced parentheses
+	i := label_end + 1
+	depth = 0
+url_loop:
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				break url_loop
+			}
+			depth--
+		case ' ', '\t', '\n':
+			break url_loop
+		}
+	}
+	i = min(i, len(text))
+	url = text[label_end+1 : i]
+	skip_spaces := func() {
+		for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\r' || text[i] == 0) {
+			i++
+		}
+	}
+	skip_spaces()
+	if i < len(text) && (text[i] == '"' || text[i] == '\'') {
+		q := strings.IndexByte(text[i+1:], text[i])
+		if q < 0 {
+			return -1, -1, ""
+		}
+		i += q + 2
+		skip_spaces()
+	}
+	if i >= len(text) || text[i] != ')' {
+		return -1, -1, ""
+	}
+	return label_end, i + 1, url
+}
+
+// mark_markdown_links creates a mark for each markdown inline link and
+// autolink, the mark covers the visible label and its text is the url
+func mark_markdown_links(text string, opts *Options) (ans []Mark) {
+	autolink_pat := utils.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>\x00]*)>`)
+	clean := func(x string) string {
+		x = strings.NewReplacer("\r", "", "\x00", "").Replace(x)
+		return utils.MustCompile(`\\([[:punct:]])`).ReplaceAllString(x, "$1")
+	}
+	add := func(start, end int, url, label string) {
+		if url = clean(url); url != "" && len([]rune(url)) >= opts.MinimumMatchLength {
+			ans = append(ans, Mark{Index: len(ans), Start: start, End: end, Text: url, Groupdict: map[string]any{"label": clean(label)}})
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '[':
+			if label_end, end, url := markdown_link_at(text, i); end > -1 {
+				add(i, label_end, url, text[i+1:label_end-1])
+				i = end - 1
+			}
+		case '<':
+			if m := autolink_pat.FindStringSubmatchIndex(text[i:]); m != nil {
+				url := text[i+m[2] : i+m[3]]
+				add(i+m[2], i+m[3], url, url)
+				i += m[1] - 1
+			}
+		}
+	}
+	return
+}
+
+// ranks_by_distance_from_cursor returns the rank of each mark when ordered by
+// the distance of its screen row from the cursor row of the overlaid window,
+// marks above the cursor being preferred. Returns nil if the cursor row is not
+// known.
+func ranks_by_distance_from_cursor(text string, marks []Mark) []int {
+	cursor_line, err := strconv.Atoi(os.Getenv("OVERLAID_WINDOW_CURSOR_LINE"))
+	if err != nil || cursor_line < 1 {
+		return nil
+	}
+	cursor_row := cursor_line - 1
+	row_starts := []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' || text[i] == '\r' {
+			row_starts = append(row_starts, i+1)
+		}
+	}
+	type item struct{ idx, distance, row, start int }
+	items := make([]item, len(marks))
+	for i, m := range marks {
+		row := sort.SearchInts(row_starts, m.Start+1) - 1
+		items[i] = item{i, utils.Abs(row - cursor_row), row, m.Start}
+	}
+	slices.SortStableFunc(items, func(a, b item) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		if a.row != b.row {
+			return a.row - b.row
+		}
+		return a.start - b.start
+	})
+	ans := make([]int, len(marks))
+	for rank, x := range items {
+		ans[x.idx] = rank
+	}
+	return ans
+}
+
 func adjust_python_offsets(text string, marks []Mark) error {
 	// python returns rune based offsets (unicode chars not utf-8 bytes)
 	adjust := utils.RuneOffsetsToByteOffsets(text)
@@ -631,6 +1484,265 @@ func adjust_python_offsets(text string, marks []Mark) error {
 	return nil
 }
 
+// unwrap_text removes the soft wrap markers and padding inserted by
+// convert_text() so that screen lines are joined into logical lines, returning
+// the offset in text of every byte of the unwrapped text
+func unwrap_text(text string) (string, []int) {
+	buf := strings.Builder{}
+	buf.Grow(len(text))
+	offsets := make([]int, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		if ch := text[i]; ch != '\r' && ch != 0 {
+			buf.WriteByte(ch)
+			offsets = append(offsets, i)
+		}
+	}
+	return buf.String(), offsets
+}
+
+// filter_marks_by_line keeps only the marks that start on a line matching
+// the specified pattern, renumbering them
+func filter_marks_by_line(text string, marks []Mark, pat *regexp2.Regexp) (ans []Mark, err error) {
+	type span struct{ start, end int }
+	matching_lines := []span{}
+	pos := 0
+	for line := range strings.SplitSeq(text, "\n") {
+		clean := strings.NewReplacer("\r", "", "\x00", "").Replace(line)
+		matched, err := pat.MatchString(clean)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matching_lines = append(matching_lines, span{pos, pos + len(line)})
+		}
+		pos += len(line) + 1
+	}
+	ans = make([]Mark, 0, len(marks))
+	for _, m := range marks {
+		if _, found := slices.BinarySearchFunc(matching_lines, m.Start, func(s span, x int) int {
+			if x < s.start {
+				return 1
+			}
+			if x > s.end {
+				return -1
+			}
+			return 0
+		}); found {
+			m.Index = len(ans)
+			ans = append(ans, m)
+		}
+	}
+	return
+}
+
+// in_region returns true if every row of the mark is within the one based
+// columns left to right, in cells, a value of zero meaning no limit. Marks
+// that are soft wrapped extend to the end of the row they start on.
+func in_region(text string, m *Mark, left, right int) bool {
+	row_start := strings.LastIndexAny(text[:m.Start], "\r\n") + 1
+	for start := m.Start; start < m.End; {
+		end := m.End
+		if i := strings.IndexAny(text[start:m.End], "\r\n"); i > -1 {
+			end = start + i
+		}
+		first := wcswidth.Stringwidth(text[row_start:start]) + 1
+		last := first + wcswidth.Stringwidth(text[start:end]) - 1
+		if (left > 0 && first < left) || (right > 0 && last > right) {
+			return false
+		}
+		start = end + 1
+		row_start = start
+	}
+	return true
+}
+
+func filter_marks_by_region(text string, marks []Mark, left, right int) (ans []Mark) {
+	ans = make([]Mark, 0, len(marks))
+	for _, m := range marks {
+		if in_region(text, &m, left, right) {
+			m.Index = len(ans)
+			ans = append(ans, m)
+		}
+	}
+	return
+}
+
+// DEFAULT_STRIP_CHARS are stripped only from the end of matches, the same
+// trailing punctuation, brackets and quotes the post-processors remove, so
+// that paths such as ./foo and .bashrc are left intact
+var DEFAULT_STRIP_CHARS = map[string]string{
+	"url":  `.,?!)]}>'"`,
+	"path": `.,?!)]}>'"`,
+}
+
+// strip_chars_for returns the characters to strip from matches and whether
+// they are stripped only from the end
+func strip_chars_for(opts *Options) (chars string, trailing_only bool) {
+	if opts.StripChars == "default" {
+		return DEFAULT_STRIP_CHARS[opts.Type], true
+	}
+	return opts.StripChars, false
+}
+
+// strip_chars removes characters in chars from both ends of text, or only the
+// end if trailing_only, returning the number of bytes removed from each end.
+// Brackets that are balanced by a matching bracket inside text are not
+// removed.
+func strip_chars(text, chars string, trailing_only bool) (lead, trail int) {
+	closer_for := map[rune]rune{'(': ')', '[': ']', '{': '}', '<': '>'}
+	opener_for := map[rune]rune{')': '(', ']': '[', '}': '{', '>': '<'}
+	for lead+trail < len(text) {
+		s := text[lead : len(text)-trail]
+		first, fsz := utf8.DecodeRuneInString(s)
+		last, lsz := utf8.DecodeLastRuneInString(s)
+		first_ok, last_ok := strings.ContainsRune(chars, first), strings.ContainsRune(chars, last)
+		// with trailing_only, only a bracket around the whole of text is
+		// removed from the start, as the brackets post-processor does
+		if (first_ok || trailing_only) && last_ok && len(s) > fsz && closer_for[first] == last {
+			lead += fsz
+			trail += lsz
+			continue
+		}
+		if last_ok {
+			if o, is_closer := opener_for[last]; !is_closer || strings.Count(s, string(o)) < strings.Count(s, string(last)) {
+				trail += lsz
+				continue
+			}
+		}
+		if first_ok && !trailing_only {
+			if c, is_opener := closer_for[first]; !is_opener || strings.Count(s, string(c)) < strings.Count(s, string(first)) {
+				lead += fsz
+				continue
+			}
+		}
+		break
+	}
+	return
+}
+
+// strip_marks strips chars from the text of every mark, moving the mark
+// boundaries to match when the mark covers exactly its text. Marks that would
+// become empty are left unchanged.
+func strip_marks(text string, marks []Mark, chars string, trailing_only bool) {
+	if chars == "" {
+		return
+	}
+	for i := range marks {
+		m := &marks[i]
+		lead, trail := strip_chars(m.Text, chars, trailing_only)
+		if lead+trail == 0 || lead+trail >= len(m.Text) {
+			continue
+		}
+		narrow_mark(text, m, lead, trail)
+	}
+}
+
+// narrow_mark removes lead and trail bytes from the text of the mark, moving
+// the mark boundaries to match, skipping line breaks, when the mark covers
+// exactly its text
+func narrow_mark(text string, m *Mark, lead, trail int) {
+	is_line_break := func(b byte) bool { return b == '\n' || b == '\r' || b == 0 }
+	if strings.NewReplacer("\n", "", "\r", "", "\x00", "").Replace(text[m.Start:m.End]) == m.Text {
+		for n := lead; n > 0; m.Start++ {
+			if !is_line_break(text[m.Start]) {
+				n--
+			}
+		}
+		for n := trail; n > 0; m.End-- {
+			if !is_line_break(text[m.End-1]) {
+				n--
+			}
+		}
+	}
+	m.Text = m.Text[lead : len(m.Text)-trail]
+}
+
+// add_context sets the prefix and suffix named groups of every mark to up to n
+// characters before and after the mark on the same line. Soft wrapped lines
+// count as a single line.
+func add_context(text string, marks []Mark, n int) {
+	clean := strings.NewReplacer("\r", "", "\x00", "")
+	for i := range marks {
+		m := &marks[i]
+		before := []rune(clean.Replace(text[strings.LastIndexByte(text[:m.Start], '\n')+1 : m.Start]))
+		after := text[m.End:]
+		if idx := strings.IndexByte(after, '\n'); idx > -1 {
+			after = after[:idx]
+		}
+		after_runes := []rune(clean.Replace(after))
+		if m.Groupdict == nil {
+			m.Groupdict = make(map[string]any)
+		}
+		m.Groupdict["prefix"] = string(before[max(0, len(before)-n):])
+		m.Groupdict["suffix"] = string(after_runes[:min(n, len(after_runes))])
+	}
+}
+
+// dedup_marks removes marks with the same text as an earlier mark,
+// renumbering them
+func dedup_marks(marks []Mark) (ans []Mark) {
+	seen := utils.NewSet[string](len(marks))
+	for _, m := range marks {
+		if !seen.Has(m.Text) {
+			seen.Add(m.Text)
+			m.Index = len(ans)
+			ans = append(ans, m)
+		}
+	}
+	return
+}
+
+// filter_nested_marks removes marks that are nested inside other marks,
+// keeping either the outermost (broadest) or innermost (narrowest) ones,
+// renumbering them
+func filter_nested_marks(marks []Mark, prefer string) (ans []Mark) {
+	contains := func(outer, inner *Mark) bool {
+		return outer.Start <= inner.Start && inner.End <= outer.End && (outer.Start != inner.Start || outer.End != inner.End)
+	}
+	ans = make([]Mark, 0, len(marks))
+	for i := range marks {
+		m := &marks[i]
+		nested := false
+		for j := range marks {
+			if i != j && ((prefer == "broadest" && contains(&marks[j], m)) || (prefer == "narrowest" && contains(m, &marks[j]))) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			q := *m
+			q.Index = len(ans)
+			ans = append(ans, q)
+		}
+	}
+	return
+}
+
+// host_for_mark returns the host component of the mark, preferring any host
+// captured by the matcher, falling back to parsing the text as a URL, an
+// email address, an ssh/scp target or an IP address.
+func host_for_mark(m *Mark) string {
+	for _, key := range []string{"host", "domain"} {
+		if h, ok := m.Groupdict[key].(string); ok && h != "" {
+			return h
+		}
+	}
+	if u, err := url.Parse(m.Text); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if idx := strings.LastIndexByte(m.Text, '@'); idx > -1 {
+		host := m.Text[idx+1:]
+		if i := strings.IndexAny(host, ":/"); i > -1 {
+			host = host[:i]
+		}
+		return host
+	}
+	if ipaddr.NewHostName(m.Text).IsAddress() {
+		return m.Text
+	}
+	return ""
+}
+
 func (self *ErrNoMatches) Error() string {
 	none_of := "matches"
 	switch self.Type {
@@ -645,7 +1757,19 @@ func (self *ErrNoMatches) Error() string {
 	return fmt.Sprintf("No %s found", none_of)
 }
 
-func find_marks(text string, opts *Options, cli_args ...string) (sanitized_text string, ans []Mark, index_map map[int]*Mark, err error) {
+// FindMarks finds the marks in text, which must be in the format produced by
+// ConvertText(), according to opts. It returns text with escape codes removed,
+// which is what the offsets in the marks refer to, the marks in order of
+// position and a map of mark index to mark. cli_args are passed to
+// --customize-processing scripts. Returns *ErrNoMatches if nothing is found.
+func FindMarks(text string, opts *Options, cli_args ...string) (sanitized_text string, ans []Mark, index_map map[int]*Mark, err error) {
+	sanitized_text, ans, index_map, _, err = find_marks(text, opts, cli_args...)
+	return
+}
+
+// find_marks is FindMarks that also returns the number of marks dropped
+// because of --max-marks
+func find_marks(text string, opts *Options, cli_args ...string) (sanitized_text string, ans []Mark, index_map map[int]*Mark, dropped int, err error) {
 	sanitized_text, hyperlinks := process_escape_codes(text)
 	used_pattern := ""
 
@@ -658,7 +1782,18 @@ func find_marks(text string, opts *Options, cli_args ...string) (sanitized_text
 		if err != nil {
 			return fmt.Errorf("Failed to compile the regex pattern: %#v with error: %w", pattern, err)
 		}
-		ans = mark(r, post_processors, group_processors, sanitized_text, opts)
+		if opts.Type == "regex" && opts.Group != "" && r.GroupNumberFromName(opts.Group) < 0 {
+			return fmt.Errorf("The regex pattern: %#v has no group named: %#v", pattern, opts.Group)
+		}
+		if opts.UnwrapBeforeMatch {
+			unwrapped, offsets := unwrap_text(sanitized_text)
+			ans = mark(r, post_processors, group_processors, unwrapped, opts)
+			for i := range ans {
+				ans[i].Start, ans[i].End = offsets[ans[i].Start], offsets[ans[i].End-1]+1
+			}
+		} else {
+			ans = mark(r, post_processors, group_processors, sanitized_text, opts)
+		}
 		used_pattern = pattern
 		return nil
 	}
@@ -678,22 +1813,28 @@ func find_marks(text string, opts *Options, cli_args ...string) (sanitized_text
 				}
 				goto process_answer
 			} else {
-				return "", nil, nil, fmt.Errorf("Failed to run custom processor %#v with error: %w\n%s", opts.CustomizeProcessing, err, stderr.String())
+				return "", nil, nil, 0, fmt.Errorf("Failed to run custom processor %#v with error: %w\n%s", opts.CustomizeProcessing, err, stderr.String())
 			}
 		}
 		ans = make([]Mark, 0, 32)
 		err = json.Unmarshal(stdout.Bytes(), &ans)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("Failed to load output from custom processor %#v with error: %w", opts.CustomizeProcessing, err)
+			return "", nil, nil, 0, fmt.Errorf("Failed to load output from custom processor %#v with error: %w", opts.CustomizeProcessing, err)
 		}
 		err = adjust_python_offsets(sanitized_text, ans)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("Custom processor %#v produced invalid mark output with error: %w", opts.CustomizeProcessing, err)
+			return "", nil, nil, 0, fmt.Errorf("Custom processor %#v produced invalid mark output with error: %w", opts.CustomizeProcessing, err)
 		}
 	} else if opts.Type == "hyperlink" {
 		ans = hyperlinks
 	} else if opts.Type == "word" {
 		ans = mark_words(sanitized_text, opts)
+	} else if opts.Type == "markdown" {
+		ans = mark_markdown_links(sanitized_text, opts)
+	} else if opts.Type == "log-entry" {
+		if ans, err = mark_log_entries(sanitized_text, opts); err != nil {
+			return "", nil, nil, 0, err
+		}
 	} else {
 		err = run_basic_matching()
 		if err != nil {
@@ -701,15 +1842,106 @@ func find_marks(text string, opts *Options, cli_args ...string) (sanitized_text
 		}
 	}
 process_answer:
+	strip_chars, trailing_only := strip_chars_for(opts)
+	strip_marks(sanitized_text, ans, strip_chars, trailing_only)
+	if opts.LineFilter != "" && len(ans) > 0 {
+		pat, cerr := regexp2.Compile(opts.LineFilter, regexp2.RE2)
+		if cerr != nil {
+			return "", nil, nil, 0, fmt.Errorf("Failed to compile the line filter pattern: %#v with error: %w", opts.LineFilter, cerr)
+		}
+		if ans, err = filter_marks_by_line(sanitized_text, ans, pat); err != nil {
+			return "", nil, nil, 0, err
+		}
+	}
+	if opts.RegionLeft > 0 || opts.RegionRight > 0 {
+		ans = filter_marks_by_region(sanitized_text, ans, opts.RegionLeft, opts.RegionRight)
+	}
+	if opts.Prefer == "broadest" || opts.Prefer == "narrowest" {
+		ans = filter_nested_marks(ans, opts.Prefer)
+	}
+	if opts.Dedup {
+		ans = dedup_marks(ans)
+	}
 	if len(ans) == 0 {
-		return "", nil, nil, &ErrNoMatches{Type: opts.Type, Pattern: used_pattern}
+		return "", nil, nil, 0, &ErrNoMatches{Type: opts.Type, Pattern: used_pattern}
+	}
+	if opts.Type == "escaped" && !opts.NoDecode {
+		families, _ := escape_families(opts)
+		for i := range ans {
+			m := &ans[i]
+			if decoded := decode_escapes(m.Text, families); decoded != m.Text {
+				if m.Groupdict == nil {
+					m.Groupdict = make(map[string]any)
+				}
+				m.Groupdict["raw"] = m.Text
+				m.Text = decoded
+			}
+		}
+	}
+	if opts.Type == "fileloc" {
+		for i := range ans {
+			ans[i].Text = ans[i].Groupdict["path"].(string)
+		}
+	}
+	if opts.Type == "traceback" {
+		for i := range ans {
+			ans[i].Text = ans[i].Groupdict["file"].(string) + ":" + ans[i].Groupdict["line"].(string)
+		}
+	}
+	if opts.Type == "call" {
+		for i := range ans {
+			m := &ans[i]
+			narrow_mark(sanitized_text, m, len(m.Text)-len(m.Groupdict["name"].(string)), 0)
+		}
+	}
+	if opts.Type == "issue" && len(opts.IssueUrl) > 0 {
+		for i := range ans {
+			if u := issue_url(opts.IssueUrl, ans[i].Groupdict); u != "" {
+				ans[i].Groupdict["url"] = u
+			}
+		}
+	}
+	if opts.Type == "quoted" {
+		for i := range ans {
+			ans[i].Text = ans[i].Groupdict["contents"].(string)
+		}
+	}
+	if part := utils.IfElse(opts.Group != "", opts.Group, opts.KeyvaluePart); (opts.Type == "keyvalue" || opts.Type == "kv") && part != "pair" {
+		for i := range ans {
+			if x, ok := ans[i].Groupdict[part].(string); ok {
+				ans[i].Text = x
+			}
+		}
+	}
+	if opts.Extract == "host" {
+		for i := range ans {
+			if host := host_for_mark(&ans[i]); host != "" {
+				ans[i].Text = host
+			}
+		}
+	}
+	if opts.ContextChars > 0 {
+		add_context(sanitized_text, ans, opts.ContextChars)
+	}
+	if opts.MaxMarks > 0 && len(ans) > opts.MaxMarks {
+		dropped = len(ans) - opts.MaxMarks
+		ans = ans[:opts.MaxMarks]
 	}
 	largest_index := ans[len(ans)-1].Index
 	offset := max(0, opts.HintsOffset)
+	// --ascending only applies to the position order, reverse always gives
+	// the lowest indices to the last marks and cursor ignores it
+	ascending := opts.Ascending && opts.HintOrder == "position"
+	var ranks []int
+	if opts.HintOrder == "cursor" {
+		ranks = ranks_by_distance_from_cursor(sanitized_text, ans)
+	}
 	index_map = make(map[int]*Mark, len(ans))
 	for i := range ans {
 		m := &ans[i]
-		if opts.Ascending {
+		if ranks != nil {
+			m.Index = ranks[i] + offset
+		} else if ascending {
 			m.Index += offset
 		} else {
 			m.Index = largest_index - m.Index + offset
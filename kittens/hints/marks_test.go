@@ -3,12 +3,14 @@
 package hints
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/kovidgoyal/kitty"
 	"github.com/kovidgoyal/kitty/tools/utils"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -32,7 +34,7 @@ func TestHintMarking(t *testing.T) {
 
 	r := func(text string, url ...string) (marks []Mark) {
 		ptext := convert_text(text, cols)
-		ptext, marks, _, err := find_marks(ptext, opts, cli_args...)
+		ptext, marks, _, err := FindMarks(ptext, opts, cli_args...)
 		if err != nil {
 			var e *ErrNoMatches
 			if len(url) != 0 || !errors.As(err, &e) {
@@ -71,7 +73,7 @@ func TestHintMarking(t *testing.T) {
 	opts.Type = "linenum"
 	m := func(text, path string, line int) {
 		ptext := convert_text(text, cols)
-		_, marks, _, err := find_marks(ptext, opts, cli_args...)
+		_, marks, _, err := FindMarks(ptext, opts, cli_args...)
 		if err != nil {
 			t.Fatalf("%#v failed with error: %s", text, err)
 		}
@@ -87,6 +89,74 @@ func TestHintMarking(t *testing.T) {
 	m("a/file.c:23:32", "a/file.c", 23)
 	m("~/file.c:23:32", utils.Expanduser("~/file.c"), 23)
 
+	reset()
+	cols = 60
+	opts.Extract = "host"
+	texts := func(text string, expected ...string) {
+		_, marks, _, err := FindMarks(convert_text(text, cols), opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		if diff := cmp.Diff(expected, utils.Map(func(m Mark) string { return m.Text }, marks)); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+	texts(`http://user@example.com:8080/x and ssh://git@host.org/y`, `example.com`, `host.org`)
+	opts.Type = "ip"
+	texts(`ping 10.0.0.1`, `10.0.0.1`)
+	opts.Type = "word"
+	texts(`me@example.org word`, `example.org`, `word`)
+
+	reset()
+	cols = 60
+	opts.Type = "escaped"
+	opts.EscapeFamilies = "percent,backslash,html"
+	texts(`GET /a%20b%C3%A9 line\x41\n. x &lt;y&gt;`, `/a bé`, "lineA\n", `<y>`)
+	opts.EscapeFamilies = "html"
+	texts(`a%20b &amp;`, `&`)
+	opts.NoDecode = true
+	texts(`x &amp;`, `&amp;`)
+	opts.EscapeFamilies = "nope"
+	if _, _, _, err := FindMarks(convert_text("x", cols), opts); err == nil {
+		t.Fatalf("No error for invalid escape family")
+	}
+
+	reset()
+	cols = 40
+	opts.LineFilter = `ERROR`
+	r("INFO http://a.com\nERROR http://b.com http://c.com\nhttp://d.com", "http://b.com", "http://c.com")
+	r("INFO http://a.com")
+	opts.LineFilter = `^\s*WARN`
+	r("WARN a long line wrapping http://a.com/wrapped\n WARN http://b.com", "http://a.com/wrapped", "http://b.com")
+
+	reset()
+	cols = 40
+	opts.Type = "log-entry"
+	opts.ContinuationPattern = `^\s`
+	texts("INFO started\nERROR failed\n  at foo()\n  at bar()\n\nWARN x", "INFO started", "ERROR failed\n  at foo()\n  at bar()", "WARN x")
+	opts.ContinuationPattern = `^[^\[]`
+	texts("[1] a\nb\n[2] c", "[1] a\nb", "[2] c")
+
+	reset()
+	cols = 60
+	opts.Type = "keyvalue"
+	opts.KeyvaluePart = "pair"
+	r(`HOME=/root TERM=xterm-kitty`, `HOME=/root`, `TERM=xterm-kitty`)
+	r(`see http://x.org/a=b`)
+	opts.KeyvaluePart = "value"
+	texts(`font_size: 11.0 name = "a \"b\" c" x='y z'`, `11.0`, `a "b" c`, `y z`)
+	opts.KeyvaluePart = "key"
+	texts(`a.b-c=1 _x: 2`, `a.b-c`, `_x`)
+	opts.Type = "kv"
+	opts.Group = "value"
+	texts(`export FOO=bar GET /x?q=a%20b&page=2`, `bar`, `a%20b`, `2`)
+	opts.Group = "pair"
+	r(`x?a=1&b="2 3"`, `a=1`, `b="2 3"`)
+	opts.Group = "path"
+	if _, _, _, err := FindMarks("a=1", opts); err == nil {
+		t.Fatalf("No error for an invalid --group with the kv type")
+	}
+
 	reset()
 	opts.Type = "path"
 	r("file.c", "file.c")
@@ -107,6 +177,267 @@ func TestHintMarking(t *testing.T) {
 	r(`::1`, `::1`)
 	r(`255.255.255.256`)
 	r(`:1`)
+	r(`net 10.0.0.0/8 and fe80::1/64 at [::1]:8080`, `10.0.0.0/8`, `fe80::1/64`, `::1`)
+	r(`1.2.3.4.5 version 1.2.3 at 12:34:56 or 10.0.0.0/33`)
+	r(`reach 1.2.3.4.`, `1.2.3.4`)
+	gr := func(text string, gd map[string]any) {
+		_, marks, _, err := FindMarks(convert_text(text, cols), opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		if diff := cmp.Diff(gd, marks[0].Groupdict); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+	gr(`192.168.1.0/24`, map[string]any{"address": "192.168.1.0", "family": "v4", "prefix": "24"})
+	gr(`2001:db8::1`, map[string]any{"address": "2001:db8::1", "family": "v6"})
+
+	reset()
+	cols = 60
+	opts.Type = "git-ref"
+	r(`on origin/main, see refs/heads/feature/x.`, `origin/main`, `refs/heads/feature/x`)
+	r(`git show HEAD~3 HEAD^2 v1.2.3`, `HEAD~3`, `HEAD^2`, `v1.2.3`)
+	r(`some/origin/main and 1.2.3`)
+	gr(`origin/main~2`, map[string]any{"remote": "origin", "ref": "main", "suffix": "~2"})
+	gr(`refs/remotes/upstream/dev`, map[string]any{"remote": "upstream", "ref": "dev", "suffix": ""})
+	gr(`refs/tags/v2.0`, map[string]any{"ref": "v2.0", "suffix": ""})
+
+	reset()
+	cols = 60
+	opts.Type = "hash"
+	opts.HashMinLength = 7
+	r(`commit 2b687c2f0e1d3c4b5a69788796a5b4c3d2e1f0a9 (HEAD) 9f8e7d6 deadbeefx abc1234`, `2b687c2f0e1d3c4b5a69788796a5b4c3d2e1f0a9`, `9f8e7d6`, `abc1234`)
+	r(`x0abc1234 abc123`)
+	r(`2b687c2f0e1d3c4b5a69788796a5b4c3d2e1f0a9b 9f8e7d6`, `9f8e7d6`)
+	r(`e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855`)
+	gr(`fixed in 2b687c2f0e1d3c4b5a69.`, map[string]any{"hash": "2b687c2f0e1d3c4b5a69", "short": "2b687c2f0e1d"})
+	opts.HashMinLength = 10
+	r(`9f8e7d6 2b687c2f0e`, `2b687c2f0e`)
+
+	reset()
+	cols = 60
+	opts.Type = "email"
+	r(`From: Me <me+tag@mail.example.co.uk>, write to a.b@x.org.`, `me+tag@mail.example.co.uk`, `a.b@x.org`)
+	r(`not@localhost or @x.org`)
+	gr(`<kovid@kovidgoyal.net>`, map[string]any{"user": "kovid", "domain": "kovidgoyal.net"})
+
+	reset()
+	cols = 60
+	opts.Type = "fileloc"
+	fl := func(text string, paths ...string) {
+		_, marks, _, _ := FindMarks(convert_text(text, cols), opts)
+		var actual []string
+		for _, m := range marks {
+			actual = append(actual, m.Text)
+		}
+		if diff := cmp.Diff(paths, actual); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+	fl(`src/main.go:42:10: error: x`, `src/main.go`)
+	fl(`C:\proj\main.c:10 and ./rel/path:3, also Makefile:7:`, `C:\proj\main.c`, `./rel/path`, `Makefile`)
+	fl(`at 12:30:45 see http://x.org:8080/a`)
+	gr(`src/main.go:42:10: error`, map[string]any{"path": "src/main.go", "line": "42", "column": "10"})
+	gr(`(./rel/path:3)`, map[string]any{"path": "./rel/path", "line": "3"})
+
+	reset()
+	cols = 80
+	opts.Type = "traceback"
+	fl("goroutine 1 [running]:\nmain.(*T).run(0xc000010000)\n\t/src/app/main.go:42 +0x1d\nmain.main()\n\t/src/app/main.go:10 +0x25", `/src/app/main.go:42`, `/src/app/main.go:10`)
+	fl("Traceback (most recent call last):\n  File \"/app/x.py\", line 12, in <module>\n    main()\n  File \"lib.py\", line 3, in main", `/app/x.py:12`, `lib.py:3`)
+	fl("Error: x\n    at Object.run (/app/index.js:10:15)\n    at async main (file:///app/m.mjs:2:1)\n    at /app/a.js:1:2\n    at node:internal/x:3:4", `/app/index.js:10`, `/app/m.mjs:2`, `/app/a.js:1`)
+	fl(`see main.go:42 or "x.py", line 3`)
+	gr("main.main()\n\t/src/main.go:10 +0x25", map[string]any{"file": "/src/main.go", "path": "/src/main.go", "line": "10", "function": "main.main"})
+	gr(`  File "/app/x.py", line 12, in run`, map[string]any{"file": "/app/x.py", "path": "/app/x.py", "line": "12", "function": "run"})
+	gr(`    at Object.run (/app/index.js:10:15)`, map[string]any{"file": "/app/index.js", "path": "/app/index.js", "line": "10", "column": "15", "function": "Object.run"})
+
+	reset()
+	cols = 60
+	opts.Type = "semver"
+	r(`upgraded foo v1.2.3-rc.1+build.5 to 2.0.0, see 1.10.0-alpha.`, `v1.2.3-rc.1+build.5`, `2.0.0`, `1.10.0-alpha`)
+	r(`1.2 and 10.0.0.1 and 1.02.3 and x1.2.3`)
+	gr(`version v1.2.3-rc.1+b7`, map[string]any{"major": "1", "minor": "2", "patch": "3", "prerelease": "rc.1", "build": "b7"})
+	gr(`(0.1.0)`, map[string]any{"major": "0", "minor": "1", "patch": "0"})
+
+	reset()
+	cols = 80
+	opts.Type = "image"
+	r(`FROM python:3.12-slim AS base, pull ghcr.io/org/app:v1.2. go github.com/a/b`, `python:3.12-slim`, `ghcr.io/org/app:v1.2`)
+	gr(`localhost:5000/team/svc:latest@sha256:abababababababababababababababababababababababababababababababab`, map[string]any{"registry": "localhost:5000", "repository": "team/svc", "tag": "latest", "digest": "sha256:abababababababababababababababababababababababababababababababab"})
+	gr(`myhost:5000/img:1`, map[string]any{"registry": "myhost:5000", "repository": "img", "tag": "1"})
+	gr(`nginx@sha256:abababababababababababababababababababababababababababababababab`, map[string]any{"repository": "nginx", "digest": "sha256:abababababababababababababababababababababababababababababababab"})
+	gr(`library/redis:7`, map[string]any{"repository": "library/redis", "tag": "7"})
+
+	reset()
+	cols = 80
+	opts.Type = "issue"
+	r(`fixes ABC-123, #4567 and org/repo#12 not a-1 or &#123; x#5`, `ABC-123`, `#4567`, `org/repo#12`)
+	gr(`see kovidgoyal/kitty#12`, map[string]any{"repo": "kovidgoyal/kitty", "number": "12"})
+	gr(`see PROJ2-7`, map[string]any{"project": "PROJ2", "number": "7"})
+	opts.IssueUrl = []string{"https://github.com/{repo}/issues/{number}", "https://jira.example.com/browse/{project}-{number}"}
+	gr(`#7`, map[string]any{"number": "7"})
+	gr(`a/b#7`, map[string]any{"repo": "a/b", "number": "7", "url": "https://github.com/a/b/issues/7"})
+	gr(`XY-7`, map[string]any{"project": "XY", "number": "7", "url": "https://jira.example.com/browse/XY-7"})
+
+	reset()
+	cols = 80
+	opts.Type = "base64"
+	opts.Base64MinLength = 20
+	r(`token: SGVsbG8sIFdvcmxkIGZyb20gYmFzZTY0IQ== ok`, `SGVsbG8sIFdvcmxkIGZyb20gYmFzZTY0IQ==`)
+	r(`internationalization /usr/local/bin/thing 2b687c2e0e5d1f6a7b8c9d0e`)
+	gr(`x=SGVsbG8sIFdvcmxkIGZyb20gYmFzZTY0IQ==`, map[string]any{"blob": "SGVsbG8sIFdvcmxkIGZyb20gYmFzZTY0IQ==", "decoded": "Hello, World from base64!"})
+	gr(`AAECAwQFBgcICQoLDA0ODxAR`, map[string]any{"blob": "AAECAwQFBgcICQoLDA0ODxAR"})
+	opts.Base64MinLength = 40
+	r(`SGVsbG8sIFdvcmxkIGZyb20gYmFzZTY0IQ==`)
+
+	reset()
+	opts.Type = "line"
+	r("  ls -la  \n\n   \nsecond line\n", "ls -la", "second line")
+	r("a line that is soft wrapped\n\tindented", "a line that is soft wrapped", "indented")
+	r("\x1b[mecho 12345\r\x1b[m678 \nx", "echo 12345678", "x")
+
+	reset()
+	cols = 40
+	opts.RegionLeft, opts.RegionRight = 5, 33
+	r("http://a.org side | http://b.org x\n日本 http://c.org | x | http://d.org", `http://b.org`, `http://c.org`)
+	opts.RegionLeft, opts.RegionRight = 0, 20
+	r("http://a.org/a/long/path/wrapped/over/ro\rws http://b.org", `http://b.org`)
+
+	reset()
+	opts.MaxMarks = 2
+	r(`one http://a.org two http://b.org three http://c.org`, `http://a.org`, `http://b.org`)
+	if _, marks, index_map, dropped, err := find_marks(convert_text(`http://a.org http://b.org http://c.org`, cols), opts); err != nil || dropped != 1 || len(marks) != 2 || index_map[0] == nil || index_map[1] == nil {
+		t.Fatalf("Unexpected result of limiting marks: %v %d %v", marks, dropped, err)
+	}
+
+	reset()
+	cols = 80
+	opts.Type = "import"
+	opts.ImportLanguages = "js,css,python,go,rust"
+	r(`import x, { y } from './util'; const a = require("lodash"); await import('@scope/pkg')`, `./util`, `lodash`, `@scope/pkg`)
+	r(`export * from "../lib"; x = "not imported"`, `../lib`)
+	r(`@import url("base.css"); @import 'theme.css';`, `base.css`, `theme.css`)
+	r("from ..pkg.mod import x\nimport os.path\nfrom . import y", `..pkg.mod`, `os.path`, `.`)
+	r("import (\n\t\"fmt\"\n\t// comment\n\tre \"regexp\"\n)\nimport \"os\"\nx := \"str\"", `fmt`, `regexp`, `os`)
+	r(`use std::io::{self, Read}; use crate::x as y; use the force`, `std::io`, `crate::x`)
+	gr(`const a = require("lodash")`, map[string]any{"specifier": "lodash", "language": "js", "kind": "require"})
+	gr(`from a.b import c`, map[string]any{"specifier": "a.b", "language": "python", "kind": "from"})
+	opts.ImportLanguages = "rust"
+	r(`import x from './util'; use a::b;`, `a::b`)
+	opts.ImportLanguages = "cobol"
+	if _, _, _, err := FindMarks(convert_text("x", cols), opts); err == nil {
+		t.Fatalf("No error for invalid import language")
+	}
+
+	reset()
+	cols = 80
+	opts.Type = "call"
+	r(`if (x) { y := foo.Bar(1, baz()) }`, `Bar`, `baz`)
+	r(`pkg::method(a) obj->run() $x() return (1)`, `method`, `run`)
+	gr(`a.b.c(1)`, map[string]any{"receiver": "a.b", "name": "c"})
+	gr(`print(1)`, map[string]any{"name": "print"})
+
+	reset()
+	cols = 80
+	opts.Type = "color"
+	r(`a { color: #fff; background: #1e1e2eCC; border: 1px solid rgb(255, 0, 0) }`, `#fff`, `#1e1e2eCC`, `rgb(255, 0, 0)`)
+	r(`fixes &#123; #abcdefg hsl(120deg 100% 50% / 50%) rgb(a, b, c)`, `hsl(120deg 100% 50% / 50%)`)
+	gr(`x: rgba(0,0,255,0.5);`, map[string]any{"color": "rgba(0,0,255,0.5)", "hex": "#0000ff80"})
+	gr(`x: #ABC`, map[string]any{"color": "#ABC", "hex": "#aabbcc"})
+
+	reset()
+	cols = 80
+	opts.Type = "k8s"
+	r(`deployment.apps/web created, pod/web-7c5d-abcde deleted, svc/api.`, `deployment.apps/web`, `pod/web-7c5d-abcde`, `svc/api`)
+	r(`Successfully assigned default/nginx-7c5d-abcde to node-1`, `default/nginx-7c5d-abcde`)
+	r(`see src/main.go, /usr/lib/x, a/b/c, ./pod/x and Pod/X`)
+	gr(`deployment.apps/web`, map[string]any{"kind": "deployment", "group": "apps", "name": "web"})
+	gr(`kube-system/coredns-abc`, map[string]any{"namespace": "kube-system", "name": "coredns-abc"})
+	gr(`cm/my.config`, map[string]any{"kind": "cm", "name": "my.config"})
+
+	reset()
+	cols = 80
+	opts.Type = "number"
+	opts.NumberCurrency, opts.NumberSeparators = "optional", ",_"
+	r(`paid $1,234.56 and 99€, -42.5 or 1_000 units.`, `$1,234.56`, `99€`, `-42.5`, `1_000`)
+	r(`v1.2.3 at 10.0.0.1 on 2024-01-02 12:30:45 id 0x1f abc123 1,5`)
+	gr(`total: -$1,234.50`, map[string]any{"currency": "$", "value": "-1234.50"})
+	gr(`costs 99€`, map[string]any{"currency": "€", "value": "99"})
+	gr(`1_000_000`, map[string]any{"value": "1000000"})
+	opts.NumberCurrency = "required"
+	r(`paid $1,234.56 for 100 items, 20€ each`, `$1,234.56`, `20€`)
+	opts.NumberCurrency, opts.NumberSeparators = "none", ""
+	r(`paid $123 for 1,000 items`, `123`)
+
+	reset()
+	cols = 80
+	opts.Type = "socket"
+	r(`tcp 10.0.0.1:443 [::1]:8080 localhost:22 db.example.com:5432.`, `10.0.0.1:443`, `[::1]:8080`, `localhost:22`, `db.example.com:5432`)
+	r(`see http://example.com:80/path and x.org:99999 line:42 12:30:45`, `example.com:80`)
+	gr(`[2001:db8::1]:443`, map[string]any{"host": "2001:db8::1", "port": "443"})
+	gr(`connect to 192.168.1.1:22`, map[string]any{"host": "192.168.1.1", "port": "22"})
+
+	reset()
+	cols = 80
+	opts.Type = "phone"
+	_, pm, _, _ := FindMarks(convert_text(`call +1 (555) 123-4567 or 555.123.4567, +44 20 7946 0958`, cols), opts)
+	if diff := cmp.Diff([]string{"+1 (555) 123-4567", "555.123.4567", "+44 20 7946 0958"}, utils.Map(func(m Mark) string { return m.Text }, pm)); diff != "" {
+		t.Fatalf("Incorrect phone numbers:\n%s", diff)
+	}
+	r(`order 123456789012 on 2024-01-15 at 10.0.0.1 ID-1234-5678 v1.2.3`)
+	gr(`tel: +49 30 1234 5678`, map[string]any{"number": "+49 30 1234 5678", "country": "49", "e164": "+493012345678"})
+	gr(`(555) 123-4567`, map[string]any{"number": "(555) 123-4567"})
+
+	reset()
+	cols = 60
+	opts.Type = "quoted"
+	q := func(text string, expected ...string) {
+		_, marks, _, _ := FindMarks(convert_text(text, cols), opts)
+		var actual []string
+		for _, m := range marks {
+			actual = append(actual, m.Groupdict["quote"].(string)+m.Text)
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+	q(`set x = "a \"b\" c" and 'single' or `+"`cmd`", `"a \"b\" c`, `'single`, "`cmd")
+	q(`don't do "" or it's fine`)
+	gr(`key: "value"`, map[string]any{"quote": `"`, "contents": "value"})
+
+	reset()
+	cols = 60
+	opts.Type = "uuid"
+	r(`id={123e4567-e89b-12d3-a456-426614174000} (6BA7B810-9DAD-11D1-80B4-00C04FD430C8)`, `123e4567-e89b-12d3-a456-426614174000`, `6BA7B810-9DAD-11D1-80B4-00C04FD430C8`)
+	r(`0123e4567-e89b-12d3-a456-426614174000 123e4567-e89b-12d3-a456-4266141740001 123e4567-e89b-12d3-a456`)
+	gr(`x 123e4567-e89b-42d3-a456-426614174000.`, map[string]any{"uuid": "123e4567-e89b-42d3-a456-426614174000", "version": "4"})
+
+	reset()
+	opts.Type = "regex"
+	opts.Regex = `(?P<a>x)(?P<b>y)?`
+	opts.MinimumMatchLength = 1
+	gr(`zz x`, map[string]any{"a": "x"})
+
+	reset()
+	opts.Type = "regex"
+	opts.Regex = `https?://\S+`
+	r("see http://ex\rample.com/path ok", "http://ex")
+	opts.UnwrapBeforeMatch = true
+	r("see http://ex\rample.com/path ok", "http://example.com/path")
+	r("a http://x.org\nb\rhttp://y.\rorg/z", "http://x.org", "http://y.org/z")
+	opts.Type = "path"
+	r("open some/dir/fi\rle.txt now", "some/dir/file.txt")
+
+	reset()
+	opts.Type = "regex"
+	opts.Regex = `(?P<key>\w+)=(?P<val>\w+)`
+	opts.Group = "val"
+	r(`a=1 bb=22`, `1`, `22`)
+	gr(`a=1`, map[string]any{"key": "a", "val": "1"})
+	opts.Group = "nope"
+	if _, _, _, err := FindMarks(convert_text("a=1", cols), opts); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("No error for non-existent group: %v", err)
+	}
 
 	reset()
 	opts.Type = "regex"
@@ -119,6 +450,10 @@ func TestHintMarking(t *testing.T) {
 	opts.Type = "word"
 	r(`#one (two) 😍 a-1b `, `#one`, `two`, `a-1b`)
 	r("fōtiz час a\u0310b ", `fōtiz`, `час`, "a\u0310b")
+	opts.WordCharacters = "_"
+	r(`foo-bar snake_case dotted.name`, `foo`, `bar`, `snake_case`, `dotted`, `name`)
+	opts.WordCharacters = "_-."
+	r(`foo-bar snake_case dotted.name`, `foo-bar`, `snake_case`, `dotted.name`)
 
 	reset()
 	tdir := t.TempDir()
@@ -142,3 +477,209 @@ def mark(text, args, Mark, extra_cli_args, *a):
 	os.WriteFile(simple, []byte(""), 0o600)
 	r("a b", `b`)
 }
+
+func TestNestedMarks(t *testing.T) {
+	marks := []Mark{{Start: 0, End: 20, Text: "url"}, {Start: 8, End: 20, Text: "path"}, {Start: 12, End: 20, Text: "file"}, {Start: 25, End: 30, Text: "other"}}
+	texts := func(prefer string, expected ...string) {
+		actual := filter_nested_marks(marks, prefer)
+		if diff := cmp.Diff(expected, utils.Map(func(m Mark) string { return m.Text }, actual)); diff != "" {
+			t.Fatalf("Failed for prefer=%s:\n%s", prefer, diff)
+		}
+		for i, m := range actual {
+			if m.Index != i {
+				t.Fatalf("Mark not renumbered for prefer=%s: %d != %d", prefer, m.Index, i)
+			}
+		}
+	}
+	texts("broadest", "url", "other")
+	texts("narrowest", "file", "other")
+}
+
+func TestDedupMarks(t *testing.T) {
+	opts := &Options{Type: "url", UrlPrefixes: "default", Regex: kitty.HintsDefaultRegex, Dedup: true}
+	ptext, marks, index_map, err := FindMarks(convert_text("http://a.org http://b.org\nhttp://a.org http://c.org http://b.org", 40), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"http://a.org", "http://b.org", "http://c.org"}, utils.Map(func(m Mark) string { return m.Text }, marks)); diff != "" {
+		t.Fatalf("Duplicates not removed:\n%s", diff)
+	}
+	if marks[0].Start != 0 || marks[1].Start != strings.Index(ptext, "http://b.org") {
+		t.Fatalf("Duplicates do not keep the first occurrence: %v", marks)
+	}
+	if len(index_map) != 3 {
+		t.Fatalf("Hints not assigned to unique matches only: %v", index_map)
+	}
+	for _, m := range marks {
+		if m.Index > 2 {
+			t.Fatalf("Unique matches not renumbered: %v", marks)
+		}
+	}
+}
+
+func TestMarkdownLinks(t *testing.T) {
+	opts := &Options{Type: "markdown"}
+	m := func(text string, expected ...string) {
+		ptext, marks, _, err := FindMarks(convert_text(text, 80), opts)
+		var e *ErrNoMatches
+		if err != nil && (len(expected) != 0 || !errors.As(err, &e)) {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		// each mark is expected as url, label and the text covered by the mark
+		var actual []string
+		for _, mark := range marks {
+			actual = append(actual, mark.Text, mark.Groupdict["label"].(string), ptext[mark.Start:mark.End])
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+	m(`see [the docs](https://x.org/a) and <https://y.org/b>.`,
+		`https://x.org/a`, `the docs`, `[the docs]`, `https://y.org/b`, `https://y.org/b`, `https://y.org/b`)
+	m(`[a [nested] label](u1) [esc \] ape](u2 "title") [w](https://en.wikipedia.org/wiki/Go_(game))`,
+		`u1`, `a [nested] label`, `[a [nested] label]`, `u2`, `esc ] ape`, `[esc \] ape]`,
+		`https://en.wikipedia.org/wiki/Go_(game)`, `w`, `[w]`)
+	m(`[![badge](img.svg)](https://ci.org)`, `https://ci.org`, `![badge](img.svg)`, `[![badge](img.svg)]`)
+	m(`\[not](a link) [no link] [empty]() <not a link> [a](b c d)`)
+}
+
+func TestHyperlinks(t *testing.T) {
+	opts := &Options{Type: "hyperlink"}
+	for _, term := range []string{"\x1b\\", "\a"} {
+		text := "a \x1b[1m\x1b]8;;http://x.org" + term + "link\x1b]8;;" + term + "\x1b[m b \x1b]8;id=1;file:///tmp" + term + "tmp\x1b]8;;" + term
+		ptext, marks, _, err := FindMarks(convert_text(text, 80), opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		var actual []string
+		for _, m := range marks {
+			actual = append(actual, m.Text, m.Group_id, ptext[m.Start:m.End])
+		}
+		if diff := cmp.Diff([]string{"http://x.org", "", "link", "file:///tmp", "1", "tmp"}, actual); diff != "" {
+			t.Fatalf("%#v failed:\n%s", text, diff)
+		}
+	}
+}
+
+func TestHintOrder(t *testing.T) {
+	opts := &Options{Type: "regex", Regex: `\w+`, HintsOffset: 0}
+	order := func(text string, expected ...string) {
+		_, marks, _, err := FindMarks(convert_text(text, 20), opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", text, err)
+		}
+		slices.SortFunc(marks, func(a, b Mark) int { return a.Index - b.Index })
+		if diff := cmp.Diff(expected, utils.Map(func(m Mark) string { return m.Text }, marks)); diff != "" {
+			t.Fatalf("Failed for hint order %s:\n%s", opts.HintOrder, diff)
+		}
+	}
+	text := "a\nb\nc\nd\ne"
+	opts.HintOrder = "position"
+	order(text, "e", "d", "c", "b", "a")
+	opts.Ascending = true
+	order(text, "a", "b", "c", "d", "e")
+	opts.HintOrder = "reverse"
+	order(text, "e", "d", "c", "b", "a")
+	opts.Ascending = false
+	order(text, "e", "d", "c", "b", "a")
+	opts.HintOrder = "cursor"
+	opts.Ascending = true
+	t.Setenv("OVERLAID_WINDOW_CURSOR_LINE", "3")
+	order(text, "c", "b", "d", "a", "e")
+	opts.Ascending = false
+	t.Setenv("OVERLAID_WINDOW_CURSOR_LINE", "")
+	order(text, "e", "d", "c", "b", "a")
+	t.Setenv("OVERLAID_WINDOW_CURSOR_LINE", "3")
+	order(text, "c", "b", "d", "a", "e")
+	order("a b\nc\rd\ne", "d", "c", "e", "a", "b")
+}
+
+func TestStripChars(t *testing.T) {
+	for _, tc := range []struct {
+		typ, text string
+		expected  []string
+	}{
+		{"url", "see http://x.com/a).", []string{"http://x.com/a"}},
+		{"url", "(see http://en.wikipedia.org/wiki/Foo_(bar)).", []string{"http://en.wikipedia.org/wiki/Foo_(bar)"}},
+		{"url", "'http://x.com/a', and", []string{"http://x.com/a"}},
+		{"path", "in [/usr/bin/foo]. and (~/a/b.txt)", []string{"/usr/bin/foo", "~/a/b.txt"}},
+		{"path", "see /usr/bin/foo, or", []string{"/usr/bin/foo"}},
+		{"path", "see ./foo/bar.txt now", []string{"./foo/bar.txt"}},
+		{"path", "in ./foo and ../foo.", []string{"./foo", "../foo"}},
+		{"path", "edit ~/.bashrc.", []string{"~/.bashrc"}},
+	} {
+		opts := &Options{Type: tc.typ, UrlPrefixes: "default", Regex: kitty.HintsDefaultRegex, StripChars: "default"}
+		text, marks, _, err := FindMarks(tc.text, opts)
+		if err != nil {
+			t.Fatalf("%#v failed with error: %s", tc.text, err)
+		}
+		actual := utils.Map(func(m Mark) string { return m.Text }, marks)
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Fatalf("%#v failed:\n%s", tc.text, diff)
+		}
+		for _, m := range marks {
+			if text[m.Start:m.End] != m.Text {
+				t.Fatalf("Mark start (%d) and end (%d) dont point to %#v in %#v", m.Start, m.End, m.Text, tc.text)
+			}
+		}
+	}
+	opts := &Options{Type: "url", UrlPrefixes: "default", Regex: kitty.HintsDefaultRegex, StripChars: ""}
+	if _, marks, _, _ := FindMarks("see http://x.com/a).", opts); marks[0].Text != "http://x.com/a)." {
+		t.Fatalf("Stripping was not disabled: %#v", marks[0].Text)
+	}
+	if lead, trail := strip_chars("**bold**", "*", false); lead != 2 || trail != 2 {
+		t.Fatalf("Custom strip chars failed: %d %d", lead, trail)
+	}
+	if lead, trail := strip_chars("..foo..", ".", true); lead != 0 || trail != 2 {
+		t.Fatalf("Trailing only strip chars failed: %d %d", lead, trail)
+	}
+}
+
+func TestCSSColorToHex(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"#f0a":                    "#ff00aa",
+		"#FF00FF":                 "#ff00ff",
+		"#ff00ffff":               "#ff00ff",
+		"rgb(100%, 50%, 0%)":      "#ff8000",
+		"rgb(10 20 30 / 0.25)":    "#0a141e40",
+		"hsl(0, 100%, 50%)":       "#ff0000",
+		"hsl(240, 100%, 25%)":     "#000080",
+		"hsla(-120, 0%, 100%, 1)": "#ffffff",
+		"rgb(1, 2)":               "",
+		"hsl(1, 2, 3)":            "",
+	} {
+		actual, _ := css_color_to_hex(spec)
+		if actual != expected {
+			t.Fatalf("%#v: expected %#v got %#v", spec, expected, actual)
+		}
+	}
+}
+
+func TestMarkAction(t *testing.T) {
+	m := &Mark{Index: 3, Text: "x"}
+	c := m.with_action(MARK_ACTION_CLOSE)
+	if m.action() != MARK_ACTION_SELECT || c.action() != MARK_ACTION_CLOSE || c.Index != 3 {
+		t.Fatalf("Unexpected actions: %#v %#v", m, c)
+	}
+	var loaded []Mark
+	if err := json.Unmarshal([]byte(`[{"index": 1, "action": "close"}, {"index": 2}]`), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded[0].action() != MARK_ACTION_CLOSE || loaded[1].action() != MARK_ACTION_SELECT {
+		t.Fatalf("Unexpected actions for loaded marks: %#v", loaded)
+	}
+}
+
+func TestContextChars(t *testing.T) {
+	opts := &Options{Type: "regex", Regex: `\d+`, ContextChars: 4}
+	text := convert_text("ab 12 cdefg\nx 345\n日本語 6 end", 30)
+	_, marks, _, err := FindMarks(text, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := utils.Map(func(m Mark) [2]any { return [2]any{m.Groupdict["prefix"], m.Groupdict["suffix"]} }, marks)
+	expected := [][2]any{{"ab ", " cde"}, {"x ", ""}, {"日本語 ", " end"}}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Fatalf("Unexpected context:\n%s", diff)
+	}
+}
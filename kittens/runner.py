@@ -91,6 +91,7 @@ def create_kitten_handler(kitten: str, orig_args: list[str]) -> KittenMetadata:
     kitten = resolved_kitten(kitten)
     main = m['start']
     handle_result = m['end']
+    open_url_handler = getattr(handle_result, 'open_url_handler', None)
     return KittenMetadata(
         handle_result=partial(handle_result, [kitten] + orig_args),
         type_of_input=getattr(handle_result, 'type_of_input', None),
@@ -98,7 +99,7 @@ def create_kitten_handler(kitten: str, orig_args: list[str]) -> KittenMetadata:
         allow_remote_control=getattr(main, 'allow_remote_control', False),
         remote_control_password=getattr(main, 'remote_control_password', True),
         has_ready_notification=getattr(handle_result, 'has_ready_notification', False),
-        open_url_handler=getattr(handle_result, 'open_url_handler', None))
+        open_url_handler=partial(open_url_handler, [kitten] + orig_args) if open_url_handler else None)
 
 
 def set_debug(kitten: str) -> None:
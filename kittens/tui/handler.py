@@ -34,6 +34,8 @@
 
 
 OpenUrlHandler = Optional[Callable[[BossType, WindowType, str, int, str], bool]]
+# kitten open URL handlers are called with the kitten arguments first
+KittenOpenUrlHandler = Optional[Callable[[Sequence[str], BossType, WindowType, str, int, str], bool]]
 
 
 class ButtonEvent(NamedTuple):
@@ -324,7 +326,7 @@ class HandleResult:
     type_of_input: str | None = None
     no_ui: bool = False
 
-    def __init__(self, impl: Callable[..., Any], type_of_input: str | None, no_ui: bool, has_ready_notification: bool, open_url_handler: OpenUrlHandler):
+    def __init__(self, impl: Callable[..., Any], type_of_input: str | None, no_ui: bool, has_ready_notification: bool, open_url_handler: KittenOpenUrlHandler):
         self.impl = impl
         self.no_ui = no_ui
         self.type_of_input = type_of_input
@@ -340,7 +342,7 @@ def result_handler(
     type_of_input: str | None = None,
     no_ui: bool = False,
     has_ready_notification: bool = Handler.overlay_ready_report_needed,
-    open_url_handler: OpenUrlHandler = None,
+    open_url_handler: KittenOpenUrlHandler = None,
 ) -> Callable[[Callable[..., Any]], HandleResult]:
 
     def wrapper(impl: Callable[..., Any]) -> HandleResult:
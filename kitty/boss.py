@@ -2153,6 +2153,7 @@ def run_kitten_with_metadata(
                 'KITTY_CHILD_PID': str(w.child.pid),
                 'OVERLAID_WINDOW_LINES': str(w.screen.lines),
                 'OVERLAID_WINDOW_COLS': str(w.screen.columns),
+                'OVERLAID_WINDOW_CURSOR_LINE': str(w.screen.cursor.y + 1),
             }
             if is_wrapped:
                 cmd = [kitten_exe(), kitten]
@@ -3143,8 +3144,8 @@ def done(data: dict[str, Any], target_window_id: int, self: Boss) -> None:
             nonlocal ans
             groupdict = data['groupdicts'][0]
             ans = idx_map[int(groupdict['index'])]
-            # Check if this is a close action (Delete key pressed)
-            if groupdict.get('close_action'):
+            # Check if this is a close action (Delete key pressed or right click)
+            if (data.get('actions') or ('select',))[0] == 'close':
                 ans = -ans  # Mark as negative to signal close
 
         def done2(target_window_id: int, self: Boss) -> None: